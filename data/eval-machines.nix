@@ -156,12 +156,42 @@ rec {
         meta = {
           description = network.description or "";
           ordering = network.ordering or { };
+          groups = flip mapAttrs (network.groups or { }) (
+            name: group:
+            let
+              # network.groups isn't a module option, so typos have to be caught here
+              unknown = subtractLists [
+                "tags"
+                "hosts"
+                "exclude"
+              ] (attrNames group);
+            in
+            if unknown != [ ] then
+              throw "network.groups.${name}: unknown attribute(s) ${concatStringsSep ", " unknown}, expected tags, hosts and exclude"
+            else
+              {
+                tags = group.tags or [ ];
+                hosts = group.hosts or [ ];
+                exclude = group.exclude or [ ];
+              }
+          );
         };
       };
 
       buildShell = network.buildShell.drvPath or null;
     };
 
+  # Evaluate a single option of the selected machines, e.g. `services.postgresql.enable`.
+  # Machines where the option isn't defined get `null`.
+  nodeAttrs =
+    { argsFile }:
+    let
+      fileArgs = builtins.fromJSON (builtins.readFile argsFile);
+      nodes' = filterAttrs (n: _v: elem n fileArgs.Names) nodes;
+      attrPath = splitString "." fileArgs.Attribute;
+    in
+    mapAttrs (_n: v: attrByPath attrPath null v.config) nodes';
+
   # Phase 2: build complete machine configurations.
   machines =
     {
@@ -179,6 +209,8 @@ rec {
           ${toString (
             mapAttrsToList (nodeName: nodeDef: ''
               ln -s ${nodeDef.config.system.build.toplevel} $out/${nodeName}
+              # only the derivation itself, not the outputs of its whole build closure
+              ln -s ${builtins.unsafeDiscardOutputDependency nodeDef.config.system.build.toplevel.drvPath} $out/${nodeName}.drv
             '') nodes'
           )}
         ''
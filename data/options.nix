@@ -26,6 +26,24 @@ let
     };
   });
 
+  fileOptionsType = submodule (_: {
+    options = {
+      owner = mkOption {
+        default = null;
+        type = nullOr ownerOptionsType;
+        description = ''
+          Owner of the file. Defaults to the owner of the secret.
+        '';
+      };
+
+      permissions = mkOption {
+        default = null;
+        type = nullOr str;
+        description = "Permissions expressed as octal. Defaults to the permissions of the secret.";
+      };
+    };
+  });
+
   keyOptionsType = submodule (_: {
     options = {
       destination = mkOption {
@@ -35,7 +53,10 @@ let
 
       source = mkOption {
         type = str;
-        description = "Local path";
+        description = ''
+          Local path. If this is a directory, the directory is uploaded as a whole and replaces the destination
+          directory once all files are in place.
+        '';
       };
 
       owner = mkOption {
@@ -52,12 +73,69 @@ let
         description = "Permissions expressed as octal.";
       };
 
+      directoryPermissions = mkOption {
+        default = "0500";
+        type = str;
+        description = ''
+          Permissions expressed as octal, for the destination directory and all directories below it.
+          Only used when `source` is a directory.
+        '';
+      };
+
+      files = mkOption {
+        default = { };
+        type = attrsOf fileOptionsType;
+        example = {
+          "ca.crt" = {
+            permissions = "0444";
+          };
+        };
+        description = ''
+          Owner and permissions of individual files, relative to `source`.
+          Only used when `source` is a directory; other files get the `owner` and `permissions` of the secret.
+        '';
+      };
+
       action = mkOption {
         default = [ ];
         type = listOf str;
         description = "Action to perform on remote host after uploading secret.";
       };
 
+      actionOrder = mkOption {
+        default = 100;
+        type = int;
+        description = ''
+          Position of the action among all post-upload actions on the host. Actions with lower values run first,
+          and actions with the same value are run in alphabetical order.
+          Secrets sharing the same action only run it once, using the lowest order among them.
+        '';
+      };
+
+      onActionFailure = mkOption {
+        default = "warn";
+        type = enum [
+          "ignore"
+          "warn"
+          "abort"
+        ];
+        description = ''
+          What to do if the action fails.
+
+          `ignore` continues silently, `warn` (the default) prints a warning and continues, and
+          `abort` stops the deployment before running any further actions or deploying additional hosts.
+          Secrets sharing the same action use the strictest policy among them.
+        '';
+      };
+
+      actionTimeout = mkOption {
+        default = 0;
+        type = int;
+        description = ''
+          Seconds to wait for the action to complete. Defaults to the value of `--timeout`.
+        '';
+      };
+
       mkDirs = mkOption {
         default = true;
         type = bool;
@@ -68,6 +146,38 @@ let
         '';
       };
 
+      stagingDirectory = mkOption {
+        default = null;
+        type = nullOr str;
+        description = ''
+          Remote directory the secret is written to before being moved to its destination.
+          Defaults to the directory of the destination. If set, it must be on the same filesystem as the
+          destination (e.g. a tmpfs like `/run/keys`), so the secret can be moved into place atomically.
+        '';
+      };
+
+      template = mkOption {
+        default = false;
+        type = bool;
+        description = ''
+          Whether the source is a Go `text/template`, which is rendered in memory per host before uploading.
+          The template has access to `.Host` (with `Name`, `TargetHost`, `TargetPort`, `TargetUser` and `Tags`)
+          and `.Values` (see `templateValues`).
+        '';
+      };
+
+      templateValues = mkOption {
+        default = { };
+        type = attrsOf str;
+        example = {
+          dbPassword = "../secrets/db-password.txt";
+        };
+        description = ''
+          Local files whose content is made available to templated secrets as `.Values.<name>`.
+          Relative paths are resolved relative to the deployment file.
+        '';
+      };
+
       uploadAt = mkOption {
         default = "pre-activation";
         type = enum [
@@ -84,6 +194,68 @@ let
     };
   });
 
+  # Options shared by all health check types, controlling when a check runs and when it's considered OK or failed
+  commonCheckOptions = {
+    after = mkOption {
+      type = listOf str;
+      description = ''
+        Descriptions of other checks (of any type) which must pass before this check is started.
+      '';
+      default = [ ];
+    };
+    maxAttempts = mkOption {
+      type = int;
+      description = "Number of attempts before the check is considered failed. 0 means no limit.";
+      default = 0;
+    };
+    deadline = mkOption {
+      type = int;
+      description = ''
+        Seconds after the first attempt, after which the check is considered failed. 0 means no deadline.
+      '';
+      default = 0;
+    };
+    initialDelay = mkOption {
+      type = int;
+      description = "Seconds to wait before the first attempt";
+      default = 0;
+    };
+    successThreshold = mkOption {
+      type = int;
+      description = "Number of consecutive successful attempts before the check is considered OK";
+      default = 1;
+    };
+    failureThreshold = mkOption {
+      type = int;
+      description = "Number of consecutive failed attempts before the check is considered failed. 0 means no limit.";
+      default = 0;
+    };
+  };
+
+  # Reject `after` references to unknown checks, and dependency cycles between checks
+  validateCheckOrdering =
+    checks:
+    let
+      allChecks =
+        checks.cmd ++ checks.http ++ checks.tcp ++ checks.systemd ++ checks.local ++ checks.prometheus;
+      descriptions = map (check: check.description) allChecks;
+      unknownReferences = concatMap (
+        check:
+        map (after: "'${check.description}' -> '${after}'") (
+          filter (after: !(elem after descriptions)) check.after
+        )
+      ) allChecks;
+      sorted = toposort (a: b: elem a.description b.after) allChecks;
+    in
+    if unknownReferences != [ ] then
+      throw "Checks are ordered after unknown checks: ${concatStringsSep ", " unknownReferences}"
+    else if sorted ? cycle then
+      throw "Checks have a dependency cycle between: ${
+        concatStringsSep ", " (map (check: "'${check.description}'") sorted.cycle)
+      }"
+    else
+      checks;
+
   healthCheckType = submodule (_: {
     options = {
       cmd = mkOption {
@@ -96,11 +268,31 @@ let
         default = [ ];
         description = "List of HTTP health checks";
       };
+      tcp = mkOption {
+        type = listOf tcpHealthCheckType;
+        default = [ ];
+        description = "List of TCP health checks";
+      };
+      systemd = mkOption {
+        type = listOf systemdHealthCheckType;
+        default = [ ];
+        description = "List of systemd health checks";
+      };
+      local = mkOption {
+        type = listOf localHealthCheckType;
+        default = [ ];
+        description = "List of command health checks run on the host running morph";
+      };
+      prometheus = mkOption {
+        type = listOf prometheusHealthCheckType;
+        default = [ ];
+        description = "List of Prometheus query health checks";
+      };
     };
   });
 
   httpHealthCheckType = types.submodule (_: {
-    options = {
+    options = commonCheckOptions // {
       description = mkOption {
         type = str;
         description = "Health check description";
@@ -145,11 +337,169 @@ let
         description = "Ignore SSL errors";
         default = false;
       };
+      caFile = mkOption {
+        type = nullOr str;
+        description = ''
+          Local path to a PEM file with the CA certificates used to verify the server, instead of the system CAs.
+          Relative paths are resolved relative to the deployment file.
+        '';
+        default = null;
+      };
+      clientCert = mkOption {
+        type = nullOr str;
+        description = ''
+          Local path to a PEM encoded client certificate. Requires `clientKey`.
+          Relative paths are resolved relative to the deployment file.
+        '';
+        default = null;
+      };
+      clientKey = mkOption {
+        type = nullOr str;
+        description = ''
+          Local path to the PEM encoded private key of the client certificate. Requires `clientCert`.
+          This is read from the host running morph, so it never ends up in the Nix store.
+          Relative paths are resolved relative to the deployment file.
+        '';
+        default = null;
+      };
+      serverName = mkOption {
+        type = nullOr str;
+        description = "Server name used for SNI and certificate verification. Defaults to the host name.";
+        default = null;
+      };
+      method = mkOption {
+        type = str;
+        description = "HTTP request method";
+        default = "GET";
+      };
+      body = mkOption {
+        type = str;
+        description = "HTTP request body";
+        default = "";
+      };
+      expectStatus = mkOption {
+        type = listOf int;
+        description = "Accepted HTTP status codes. If empty, any 2xx status code is accepted.";
+        default = [ ];
+      };
+      expectHeaders = mkOption {
+        type = attrsOf str;
+        description = "HTTP response headers that must have exactly these values";
+        default = { };
+      };
+      expectBody = mkOption {
+        type = str;
+        description = "String the response body must contain";
+        default = "";
+      };
+      expectBodyRegex = mkOption {
+        type = str;
+        description = "Regular expression (Go syntax) the response body must match";
+        default = "";
+      };
+      expectJson = mkOption {
+        type = attrsOf str;
+        example = {
+          "status" = "ok";
+          "checks.0.healthy" = "true";
+        };
+        description = ''
+          Values expected in a JSON response body, by dot separated path.
+          Strings are compared as is, other values by their JSON representation (e.g. `true`, `42` or `null`).
+        '';
+        default = { };
+      };
+    };
+  });
+
+  tcpHealthCheckType = types.submodule (_: {
+    options = commonCheckOptions // {
+      description = mkOption {
+        type = str;
+        description = "Health check description";
+      };
+      host = mkOption {
+        type = nullOr str;
+        description = "Host name";
+        default = null;
+      };
+      port = mkOption {
+        type = int;
+        description = "Port number";
+      };
+      send = mkOption {
+        type = str;
+        description = "Data to send after connecting, e.g. \"QUIT\\r\\n\"";
+        default = "";
+      };
+      expect = mkOption {
+        type = str;
+        description = "String the response must contain, e.g. a banner. The response isn't read if this is empty.";
+        default = "";
+      };
+      tls = mkOption {
+        type = bool;
+        description = "Whether to perform a TLS handshake after connecting";
+        default = false;
+      };
+      insecureSSL = mkOption {
+        type = bool;
+        description = "Ignore SSL errors";
+        default = false;
+      };
+      period = mkOption {
+        type = int;
+        description = "Seconds between checks";
+        default = 2;
+      };
+      timeout = mkOption {
+        type = int;
+        description = "Timeout in seconds";
+        default = 5;
+      };
+    };
+  });
+
+  systemdHealthCheckType = types.submodule (_: {
+    options = commonCheckOptions // {
+      description = mkOption {
+        type = str;
+        description = "Health check description";
+      };
+      units = mkOption {
+        type = listOf str;
+        description = "Units that must be active";
+        default = [ ];
+        example = [
+          "nginx.service"
+          "postgresql.service"
+        ];
+      };
+      noFailedUnits = mkOption {
+        type = bool;
+        description = "Whether to fail if any unit on the host is in the failed state";
+        default = false;
+      };
+      journalLines = mkOption {
+        type = int;
+        description = "Number of journal lines to show for each unhealthy unit. 0 disables this.";
+        default = 10;
+      };
+      period = mkOption {
+        type = int;
+        description = "Seconds between checks";
+        default = 2;
+      };
+      timeout = mkOption {
+        type = int;
+        description = "Timeout in seconds";
+        default = 5;
+      };
     };
   });
 
   cmdHealthCheckType = types.submodule (_: {
-    options = {
+    options = commonCheckOptions // {
       description = mkOption {
         type = str;
         description = "Health check description";
@@ -172,6 +522,94 @@ let
     };
   });
 
+  localHealthCheckType = types.submodule (_: {
+    options = commonCheckOptions // {
+      description = mkOption {
+        type = str;
+        description = "Health check description";
+      };
+      cmd = mkOption {
+        type = listOf str;
+        description = ''
+          Command to run as list. The command is run on the host running morph, with the environment variables
+          `MORPH_HOST_NAME`, `MORPH_TARGET_HOST`, `MORPH_TARGET_PORT` and `MORPH_TARGET_USER` describing the host being checked.
+        '';
+      };
+      period = mkOption {
+        type = int;
+        description = "Seconds between checks";
+        default = 2;
+      };
+      timeout = mkOption {
+        type = int;
+        description = "Timeout in seconds";
+        default = 5;
+      };
+    };
+  });
+
+  prometheusHealthCheckType = types.submodule (_: {
+    options = commonCheckOptions // {
+      description = mkOption {
+        type = str;
+        description = "Health check description";
+      };
+      url = mkOption {
+        type = str;
+        description = "Base URL of a Prometheus compatible HTTP API";
+        example = "http://prometheus.example.com:9090";
+      };
+      query = mkOption {
+        type = str;
+        description = ''
+          PromQL expression returning a scalar or an instant vector. The expression is a Go `text/template`,
+          with access to `.Name`, `.TargetHost`, `.TargetPort` and `.TargetUser` of the host being checked.
+        '';
+        example = ''sum(rate(http_requests_total{instance="{{ .Name }}",code=~"5.."}[5m]))'';
+      };
+      comparison = mkOption {
+        type = enum [
+          "<"
+          "<="
+          "=="
+          "!="
+          ">="
+          ">"
+        ];
+        description = "How each sample of the result is compared to `value`";
+      };
+      value = mkOption {
+        type = either int float;
+        description = "Value the samples of the result are compared to";
+      };
+      passOnEmpty = mkOption {
+        type = bool;
+        description = "Whether the check passes if the query returns no samples";
+        default = false;
+      };
+      headers = mkOption {
+        type = attrsOf str;
+        description = "HTTP request headers, e.g. for authentication";
+        default = { };
+      };
+      insecureSSL = mkOption {
+        type = bool;
+        description = "Ignore SSL errors";
+        default = false;
+      };
+      period = mkOption {
+        type = int;
+        description = "Seconds between checks";
+        default = 2;
+      };
+      timeout = mkOption {
+        type = int;
+        description = "Timeout in seconds";
+        default = 5;
+      };
+    };
+  });
+
 in
 {
   options.deployment = {
@@ -252,6 +690,7 @@ in
         Health check configuration.
       '';
       default = { };
+      apply = validateCheckOrdering;
     };
 
     preDeployChecks = mkOption {
@@ -260,6 +699,7 @@ in
         Pre-check configuration.
       '';
       default = { };
+      apply = validateCheckOrdering;
     };
     tags = mkOption {
       type = listOf str;
@@ -272,12 +712,16 @@ in
 
   # Creates a txt-file that lists all system healthcheck commands
   # The file will end up linked in /run/current-system along with
-  # all derived dependencies.
+  # all derived dependencies. This also ensures local health check commands
+  # are built on the host running morph.
   config.system.extraDependencies =
     let
-      cmds = concatMap (h: h.cmd) (
-        config.deployment.preDeployChecks.cmd ++ config.deployment.healthChecks.cmd
-      );
+      checks =
+        config.deployment.preDeployChecks.cmd
+        ++ config.deployment.healthChecks.cmd
+        ++ config.deployment.preDeployChecks.local
+        ++ config.deployment.healthChecks.local;
+      cmds = concatMap (h: h.cmd) checks;
     in
     [ (pkgs.writeText "healthcheck-commands.txt" (concatStringsSep "\n" cmds)) ];
 }
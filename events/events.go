@@ -0,0 +1,185 @@
+package events
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	FormatText = "text"
+	FormatJSON = "json"
+)
+
+const (
+	HostsSelected  = "hosts-selected"
+	HostSelected   = "host-selected"
+	BuildStarted   = "build-started"
+	BuildFinished  = "build-finished"
+	BuildFailed    = "build-failed"
+	PushPath       = "push-path"
+	SecretUploaded = "secret-uploaded"
+	SecretFailed   = "secret-failed"
+	SecretAction   = "secret-action"
+	Activation     = "activation"
+	Reboot         = "reboot"
+	CheckAttempt   = "check-attempt"
+	CheckResult    = "check-result"
+	ChecksFinished = "checks-finished"
+	HostDone       = "host-done"
+	HostFailed     = "host-failed"
+	CommandOutput  = "output"
+	Message        = "message"
+	Error          = "error"
+)
+
+// An event is written as a single line of JSON, e.g.
+//
+//	{"time":"2020-01-01T12:00:00.000Z","event":"push-path","host":"web01","data":{"path":"/nix/store/..."}}
+//
+// With the text format only the message is written, exactly as given.
+type Event struct {
+	Time    time.Time              `json:"time"`
+	Type    string                 `json:"event"`
+	Host    string                 `json:"host,omitempty"`
+	Message string                 `json:"message,omitempty"`
+	Data    map[string]interface{} `json:"data,omitempty"`
+}
+
+var (
+	format            = FormatText
+	output  io.Writer = os.Stderr
+	outputM sync.Mutex
+)
+
+func SetFormat(newFormat string) error {
+	switch newFormat {
+	case FormatText, FormatJSON:
+		format = newFormat
+		return nil
+	default:
+		return fmt.Errorf("Unknown output format: %s", newFormat)
+	}
+}
+
+func JSON() bool {
+	return format == FormatJSON
+}
+
+// Write an event to stderr
+func Emit(event Event) {
+	EmitTo(output, event)
+}
+
+// Write an event to out when using the text format. Events are always written to stderr when using the
+// JSON format, since each of them is a single line.
+func EmitTo(out io.Writer, event Event) {
+	if event.Time.IsZero() {
+		event.Time = time.Now()
+	}
+
+	if !JSON() {
+		if event.Message != "" {
+			fmt.Fprint(out, event.Message)
+		}
+		return
+	}
+
+	// messages are formatted for the text output, but a JSON event is a line of its own
+	event.Message = strings.TrimSpace(event.Message)
+	if event.Type == Message && event.Message == "" {
+		return
+	}
+
+	line, err := json.Marshal(event)
+	if err != nil {
+		// data is always built from plain values, so this should never happen
+		line, _ = json.Marshal(Event{Time: event.Time, Type: Error, Host: event.Host, Message: err.Error()})
+	}
+
+	outputM.Lock()
+	defer outputM.Unlock()
+	output.Write(append(line, '\n'))
+}
+
+// Free-form progress output. With the JSON format, non-empty messages become "message" events.
+func Printf(format string, args ...interface{}) {
+	Emit(Event{Type: Message, Message: fmt.Sprintf(format, args...)})
+}
+
+func Println(args ...interface{}) {
+	Emit(Event{Type: Message, Message: fmt.Sprintln(args...)})
+}
+
+// Like Printf, but the message is about a specific host
+func HostPrintf(host string, format string, args ...interface{}) {
+	Emit(Event{Type: Message, Host: host, Message: fmt.Sprintf(format, args...)})
+}
+
+// Progress output which is only meaningful on a terminal (e.g. dots printed while waiting),
+// and is left out when using the JSON format
+func Progress(text string) {
+	if !JSON() {
+		fmt.Fprint(output, text)
+	}
+}
+
+// A writer for the output of a command (e.g. nix-build or a command run over ssh). With the text format
+// this is stderr itself, so commands can still tell they are writing to a terminal. With the JSON format
+// each line becomes an "output" event. The returned function must be called once the command has finished,
+// to emit the last line if it isn't terminated.
+func Output(host string, source string) (io.Writer, func()) {
+	if !JSON() {
+		return output, func() {}
+	}
+	writer := &lineWriter{host: host, source: source}
+	return writer, writer.flush
+}
+
+type lineWriter struct {
+	host   string
+	source string
+	mu     sync.Mutex
+	buffer bytes.Buffer
+}
+
+func (w *lineWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	w.buffer.Write(p)
+	for {
+		index := bytes.IndexByte(w.buffer.Bytes(), '\n')
+		if index < 0 {
+			break
+		}
+		line := string(w.buffer.Next(index + 1))
+		w.emit(strings.TrimRight(line, "\r\n"))
+	}
+
+	return len(p), nil
+}
+
+func (w *lineWriter) flush() {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+
+	if w.buffer.Len() > 0 {
+		w.emit(strings.TrimRight(w.buffer.String(), "\r\n"))
+		w.buffer.Reset()
+	}
+}
+
+func (w *lineWriter) emit(line string) {
+	Emit(Event{
+		Type:    CommandOutput,
+		Host:    w.host,
+		Message: line,
+		Data:    map[string]interface{}{"source": w.source},
+	})
+}
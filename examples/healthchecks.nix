@@ -51,6 +51,27 @@ in
             host = "some-other-host.example.com"; # defaults to the hostname of the host if unset
             path = "/health";
             description = "Check whether $imaginaryService is running.";
+            after = [ "Check whether nginx is running." ]; # only start this check once nginx is up
+            expectJson = {
+              status = "ok"; # fail on e.g. {"status":"degraded"}, even if the status code is 200
+            };
+          }
+        ];
+
+        systemd = [
+          {
+            units = [ "nginx.service" ];
+            noFailedUnits = true;
+            description = "Check that nginx is active, and that no units have failed.";
+          }
+        ];
+
+        tcp = [
+          {
+            port = 25;
+            send = "QUIT\r\n";
+            expect = "220 "; # the SMTP greeting
+            description = "Check whether the mail server is answering.";
           }
         ];
       };
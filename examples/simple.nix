@@ -14,6 +14,11 @@ in
         "web"
       ];
     };
+    groups = {
+      frontend = {
+        tags = [ "web" ];
+      };
+    };
   };
 
   "web01" =
@@ -1,20 +1,18 @@
 package filter
 
 import (
+	"fmt"
+
 	"github.com/DBCDK/morph/nix"
 	"github.com/gobwas/glob"
 )
 
-func MatchHosts(allHosts []nix.Host, pattern string) (hosts []nix.Host, err error) {
-	g := glob.MustCompile(pattern)
-
-	for _, host := range allHosts {
-		if g.Match(host.Name) {
-			hosts = append(hosts, host)
-		}
+func compileGlob(pattern string) (glob.Glob, error) {
+	g, err := glob.Compile(pattern)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid glob pattern %q: %s", pattern, err)
 	}
-
-	return
+	return g, nil
 }
 
 func FilterHosts(allHosts []nix.Host, skip int, every int, limit int) (hosts []nix.Host) {
@@ -0,0 +1,88 @@
+package filter
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"github.com/DBCDK/morph/nix"
+)
+
+// Select the hosts which are members of any of the named groups, preserving their order.
+// A host is a member of a group if it has all of the group's tags, or its name matches one of the group's
+// host patterns, unless it matches one of the group's exclude patterns. A group without tags and host
+// patterns is an error rather than all hosts, since it's most likely a mistake in the deployment.
+func FilterHostsGroups(allHosts []nix.Host, groups map[string]nix.HostGroup, names []string) (hosts []nix.Host, err error) {
+	if len(names) == 0 {
+		return allHosts, nil
+	}
+
+	members := make(map[string]bool)
+	for _, name := range names {
+		group, ok := groups[name]
+		if !ok {
+			return hosts, unknownGroupError(name, groups)
+		}
+
+		groupHosts, err := groupMembers(allHosts, group)
+		if err != nil {
+			return hosts, fmt.Errorf("Error in host group %q: %s", name, err)
+		}
+		for _, host := range groupHosts {
+			members[host.Name] = true
+		}
+	}
+
+	for _, host := range allHosts {
+		if members[host.Name] {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts, nil
+}
+
+func groupMembers(allHosts []nix.Host, group nix.HostGroup) (hosts []nix.Host, err error) {
+	if len(group.Tags) == 0 && len(group.Hosts) == 0 {
+		return hosts, fmt.Errorf("the group has neither tags nor hosts (use hosts = [ \"*\" ] to select all hosts)")
+	}
+
+	selector, err := NewNameSelector(group.Hosts, nil, group.Exclude)
+	if err != nil {
+		return hosts, err
+	}
+
+	for _, host := range allHosts {
+		if selector.excluded(host.Name) {
+			continue
+		}
+
+		include := false
+		if len(group.Tags) > 0 && len(FilterHostsTags([]nix.Host{host}, group.Tags)) > 0 {
+			include = true
+		}
+		if len(group.Hosts) > 0 && selector.included(host.Name, nil) {
+			include = true
+		}
+
+		if include {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return hosts, nil
+}
+
+func unknownGroupError(name string, groups map[string]nix.HostGroup) error {
+	if len(groups) == 0 {
+		return fmt.Errorf("Unknown host group %q: the deployment doesn't declare any groups in network.groups", name)
+	}
+
+	available := make([]string, 0, len(groups))
+	for group := range groups {
+		available = append(available, group)
+	}
+	sort.Strings(available)
+
+	return fmt.Errorf("Unknown host group %q, available groups: %s", name, strings.Join(available, ", "))
+}
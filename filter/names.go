@@ -0,0 +1,141 @@
+package filter
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"regexp"
+	"regexp/syntax"
+	"strings"
+
+	"github.com/DBCDK/morph/nix"
+	"github.com/gobwas/glob"
+)
+
+// Selects hosts by name. A host is selected if it matches any of the globs or regular expressions,
+// or is one of the listed names, unless it matches one of the exclude globs.
+// If no globs, regular expressions or list of names are given, all hosts that aren't excluded are selected.
+type NameSelector struct {
+	globs    []glob.Glob
+	regexes  []*regexp.Regexp
+	names    []string
+	excludes []glob.Glob
+	// set once a list of names is given, even if it's empty
+	namesGiven bool
+}
+
+// Compile all patterns up front, so invalid patterns are reported before the deployment is evaluated
+func NewNameSelector(globs []string, regexes []string, excludes []string) (selector NameSelector, err error) {
+	for _, pattern := range globs {
+		g, err := compileGlob(pattern)
+		if err != nil {
+			return selector, err
+		}
+		selector.globs = append(selector.globs, g)
+	}
+
+	for _, pattern := range regexes {
+		// anchored, so the whole name has to match like with globs
+		re, err := regexp.Compile("^(?:" + pattern + ")$")
+		if err != nil {
+			// the parser's message quotes the anchored expression, which isn't what the user wrote
+			if syntaxErr, ok := err.(*syntax.Error); ok {
+				return selector, fmt.Errorf("Invalid regular expression %q: %s", pattern, syntaxErr.Code)
+			}
+			return selector, fmt.Errorf("Invalid regular expression %q: %s", pattern, err)
+		}
+		selector.regexes = append(selector.regexes, re)
+	}
+
+	for _, pattern := range excludes {
+		g, err := compileGlob(pattern)
+		if err != nil {
+			return selector, err
+		}
+		selector.excludes = append(selector.excludes, g)
+	}
+
+	return selector, nil
+}
+
+// Also select the listed hosts. An empty list selects no hosts on its own, rather than all of them,
+// so e.g. an empty --hosts-from file doesn't deploy everything.
+func (selector *NameSelector) AddNames(names []string) {
+	selector.names = append(selector.names, names...)
+	selector.namesGiven = true
+}
+
+func (selector NameSelector) included(name string, names map[string]bool) bool {
+	if len(selector.globs) == 0 && len(selector.regexes) == 0 && !selector.namesGiven {
+		return true
+	}
+
+	if names[name] {
+		return true
+	}
+	for _, g := range selector.globs {
+		if g.Match(name) {
+			return true
+		}
+	}
+	for _, re := range selector.regexes {
+		if re.MatchString(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+func (selector NameSelector) excluded(name string) bool {
+	for _, g := range selector.excludes {
+		if g.Match(name) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// Select hosts, preserving their order. Listed names that don't match any host are reported as an error,
+// since they are most likely typos.
+func (selector NameSelector) Select(allHosts []nix.Host) (hosts []nix.Host, err error) {
+	names := make(map[string]bool)
+	for _, name := range selector.names {
+		names[name] = true
+	}
+
+	known := make(map[string]bool)
+	for _, host := range allHosts {
+		known[host.Name] = true
+		if selector.included(host.Name, names) && !selector.excluded(host.Name) {
+			hosts = append(hosts, host)
+		}
+	}
+
+	var unknown []string
+	for _, name := range selector.names {
+		if !known[name] {
+			unknown = append(unknown, name)
+		}
+	}
+	if len(unknown) > 0 {
+		return nil, fmt.Errorf("Unknown host(s) in host list: %s", strings.Join(unknown, ", "))
+	}
+
+	return hosts, nil
+}
+
+// Read host names, one per line. Blank lines and lines starting with '#' are ignored.
+func ReadHostNames(reader io.Reader) (names []string, err error) {
+	scanner := bufio.NewScanner(reader)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		names = append(names, line)
+	}
+
+	return names, scanner.Err()
+}
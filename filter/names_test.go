@@ -0,0 +1,129 @@
+package filter
+
+import (
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/DBCDK/morph/nix"
+)
+
+func TestNameSelectorSelect(t *testing.T) {
+	hosts := []string{"web01", "web02", "db01", "db02", "cache01"}
+
+	tests := []struct {
+		name     string
+		globs    []string
+		regexes  []string
+		excludes []string
+		// nil means no list of names was given
+		names []string
+		want  []string
+	}{
+		{name: "nothing given selects all", want: hosts},
+		{name: "glob", globs: []string{"web*"}, want: []string{"web01", "web02"}},
+		{name: "repeated globs", globs: []string{"web01", "db*"}, want: []string{"web01", "db01", "db02"}},
+		{name: "regex is anchored", regexes: []string{"db0[12]", "b0"}, want: []string{"db01", "db02"}},
+		{name: "glob or regex", globs: []string{"cache*"}, regexes: []string{"web02"}, want: []string{"web02", "cache01"}},
+		{name: "exclude only", excludes: []string{"db*"}, want: []string{"web01", "web02", "cache01"}},
+		{name: "exclude takes precedence over glob", globs: []string{"web*"}, excludes: []string{"web02"}, want: []string{"web01"}},
+		{name: "exclude takes precedence over names", names: []string{"db01", "db02"}, excludes: []string{"db02"}, want: []string{"db01"}},
+		{name: "names keep host order", names: []string{"db02", "web01"}, want: []string{"web01", "db02"}},
+		{name: "names or glob", globs: []string{"cache*"}, names: []string{"web02"}, want: []string{"web02", "cache01"}},
+		{name: "empty list of names selects nothing", names: []string{}, want: nil},
+		{name: "empty list of names with glob", globs: []string{"db01"}, names: []string{}, want: []string{"db01"}},
+		{name: "no matches", globs: []string{"mail*"}, want: nil},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			selector, err := NewNameSelector(test.globs, test.regexes, test.excludes)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if test.names != nil {
+				selector.AddNames(test.names)
+			}
+
+			selected, err := selector.Select(testHostsNamed(hosts...))
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := hostNames(selected); !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %v, want %v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestNameSelectorUnknownNames(t *testing.T) {
+	selector, err := NewNameSelector(nil, nil, nil)
+	if err != nil {
+		t.Fatalf("unexpected error: %s", err)
+	}
+	selector.AddNames([]string{"web01", "web03", "db9"})
+
+	_, err = selector.Select(testHostsNamed("web01", "web02"))
+	if err == nil {
+		t.Fatal("expected an error")
+	}
+	if want := "Unknown host(s) in host list: web03, db9"; err.Error() != want {
+		t.Errorf("got %q, want %q", err, want)
+	}
+}
+
+func TestNewNameSelectorErrors(t *testing.T) {
+	tests := []struct {
+		name     string
+		globs    []string
+		regexes  []string
+		excludes []string
+		message  string
+	}{
+		{name: "glob", globs: []string{"web[01"}, message: `Invalid glob pattern "web[01"`},
+		{name: "exclude", excludes: []string{"db[0"}, message: `Invalid glob pattern "db[0"`},
+		{name: "regex", regexes: []string{"web(0"}, message: `Invalid regular expression "web(0": missing closing )`},
+		{name: "regex repetition", regexes: []string{"*web"}, message: `Invalid regular expression "*web": missing argument to repetition operator`},
+	}
+
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			_, err := NewNameSelector(test.globs, test.regexes, test.excludes)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+			if !strings.HasPrefix(err.Error(), test.message) {
+				t.Errorf("got %q, want it to start with %q", err, test.message)
+			}
+		})
+	}
+}
+
+func TestReadHostNames(t *testing.T) {
+	tests := []struct {
+		input string
+		want  []string
+	}{
+		{"", nil},
+		{"# only a comment\n\n   \n", nil},
+		{"web01\nweb02\n", []string{"web01", "web02"}},
+		{"  web01  \r\n# db01\n\ndb02", []string{"web01", "db02"}},
+	}
+
+	for _, test := range tests {
+		got, err := ReadHostNames(strings.NewReader(test.input))
+		if err != nil {
+			t.Fatalf("%q: unexpected error: %s", test.input, err)
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%q: got %v, want %v", test.input, got, test.want)
+		}
+	}
+}
+
+func testHostsNamed(names ...string) (hosts []nix.Host) {
+	for _, name := range names {
+		hosts = append(hosts, nix.Host{Name: name})
+	}
+	return
+}
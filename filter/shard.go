@@ -0,0 +1,58 @@
+package filter
+
+import (
+	"fmt"
+	"math/rand"
+	"strconv"
+	"strings"
+
+	"github.com/DBCDK/morph/nix"
+)
+
+// Shuffle hosts in a random order, which is the same every time for a given seed
+func ShuffleHosts(allHosts []nix.Host, seed int64) (hosts []nix.Host) {
+	hosts = make([]nix.Host, len(allHosts))
+	copy(hosts, allHosts)
+
+	random := rand.New(rand.NewSource(seed))
+	random.Shuffle(len(hosts), func(i, j int) {
+		hosts[i], hosts[j] = hosts[j], hosts[i]
+	})
+
+	return hosts
+}
+
+// Parse a shard specification of the form "i/n", where 1 <= i <= n
+func ParseShard(shard string) (index int, count int, err error) {
+	parts := strings.Split(shard, "/")
+	if len(parts) != 2 {
+		return 0, 0, fmt.Errorf("Invalid shard %q: expected the form i/n, e.g. 1/4", shard)
+	}
+
+	index, err = strconv.Atoi(parts[0])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid shard %q: %q is not a number", shard, parts[0])
+	}
+	count, err = strconv.Atoi(parts[1])
+	if err != nil {
+		return 0, 0, fmt.Errorf("Invalid shard %q: %q is not a number", shard, parts[1])
+	}
+
+	if count < 1 || index < 1 || index > count {
+		return 0, 0, fmt.Errorf("Invalid shard %q: shard number must be between 1 and %d", shard, count)
+	}
+
+	return index, count, nil
+}
+
+// Select the index'th of count shards of the hosts, by distributing the hosts round-robin.
+// The shards don't overlap, and together they contain all the hosts.
+func ShardHosts(allHosts []nix.Host, index int, count int) (hosts []nix.Host) {
+	for position, host := range allHosts {
+		if position%count == index-1 {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return
+}
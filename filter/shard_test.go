@@ -0,0 +1,120 @@
+package filter
+
+import (
+	"fmt"
+	"reflect"
+	"sort"
+	"testing"
+
+	"github.com/DBCDK/morph/nix"
+)
+
+func testHosts(count int) (hosts []nix.Host) {
+	for i := 0; i < count; i++ {
+		hosts = append(hosts, nix.Host{Name: fmt.Sprintf("host%02d", i)})
+	}
+	return
+}
+
+func TestParseShard(t *testing.T) {
+	tests := []struct {
+		shard string
+		index int
+		count int
+		valid bool
+	}{
+		{"1/1", 1, 1, true},
+		{"1/4", 1, 4, true},
+		{"4/4", 4, 4, true},
+		{"0/4", 0, 0, false},
+		{"5/4", 0, 0, false},
+		{"1/0", 0, 0, false},
+		{"-1/4", 0, 0, false},
+		{"1", 0, 0, false},
+		{"1/2/3", 0, 0, false},
+		{"a/4", 0, 0, false},
+		{"1/b", 0, 0, false},
+		{"", 0, 0, false},
+	}
+
+	for _, test := range tests {
+		index, count, err := ParseShard(test.shard)
+		if test.valid && err != nil {
+			t.Errorf("%q: unexpected error: %s", test.shard, err)
+		}
+		if !test.valid && err == nil {
+			t.Errorf("%q: expected an error", test.shard)
+		}
+		if index != test.index || count != test.count {
+			t.Errorf("%q: got %d/%d, want %d/%d", test.shard, index, count, test.index, test.count)
+		}
+	}
+}
+
+func TestShardHostsPartition(t *testing.T) {
+	for _, hostCount := range []int{0, 1, 2, 7, 10, 31} {
+		for _, shardCount := range []int{1, 2, 3, 4, 10, 40} {
+			t.Run(fmt.Sprintf("%d hosts in %d shards", hostCount, shardCount), func(t *testing.T) {
+				hosts := testHosts(hostCount)
+
+				seen := make(map[string]int)
+				var all []string
+				for index := 1; index <= shardCount; index++ {
+					shard := ShardHosts(hosts, index, shardCount)
+
+					// shards differ in size by at most one host
+					if size := len(shard); size < hostCount/shardCount || size > (hostCount+shardCount-1)/shardCount {
+						t.Errorf("shard %d/%d has %d hosts", index, shardCount, size)
+					}
+
+					for _, host := range shard {
+						seen[host.Name]++
+						all = append(all, host.Name)
+					}
+				}
+
+				for name, times := range seen {
+					if times != 1 {
+						t.Errorf("%s is in %d shards", name, times)
+					}
+				}
+
+				sort.Strings(all)
+				if want := hostNames(hosts); !reflect.DeepEqual(all, want) {
+					t.Errorf("shards together contain %v, want %v", all, want)
+				}
+			})
+		}
+	}
+}
+
+func TestShardHostsKeepsOrder(t *testing.T) {
+	hosts := testHosts(7)
+
+	got := hostNames(ShardHosts(hosts, 2, 3))
+	want := []string{"host01", "host04"}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestShuffleHosts(t *testing.T) {
+	hosts := testHosts(20)
+
+	first := hostNames(ShuffleHosts(hosts, 42))
+	second := hostNames(ShuffleHosts(hosts, 42))
+	if !reflect.DeepEqual(first, second) {
+		t.Errorf("shuffling with the same seed gave %v and %v", first, second)
+	}
+
+	if other := hostNames(ShuffleHosts(hosts, 43)); reflect.DeepEqual(first, other) {
+		t.Errorf("shuffling with different seeds gave the same order %v", first)
+	}
+
+	// the shuffled hosts are a permutation of the input, which is left untouched
+	sorted := append([]string(nil), first...)
+	sort.Strings(sorted)
+	if original := hostNames(hosts); !reflect.DeepEqual(original, sorted) {
+		t.Errorf("shuffled hosts %v aren't a permutation of %v", first, original)
+	}
+}
@@ -0,0 +1,282 @@
+package filter
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+
+	"github.com/DBCDK/morph/nix"
+)
+
+// A boolean expression over host tags, e.g. "prod and not (db or rack-17)".
+// Commas are equivalent to "and", so "prod,master" still selects hosts tagged with both.
+type TagExpression interface {
+	Match(tags []string) bool
+	String() string
+}
+
+type tagTerm string
+
+type notExpression struct {
+	operand TagExpression
+}
+
+type andExpression struct {
+	left, right TagExpression
+}
+
+type orExpression struct {
+	left, right TagExpression
+}
+
+func (tag tagTerm) Match(tags []string) bool {
+	for _, hostTag := range tags {
+		if hostTag == string(tag) {
+			return true
+		}
+	}
+	return false
+}
+
+func (tag tagTerm) String() string {
+	return string(tag)
+}
+
+func (expr notExpression) Match(tags []string) bool {
+	return !expr.operand.Match(tags)
+}
+
+func (expr notExpression) String() string {
+	return fmt.Sprintf("not %s", expr.operand)
+}
+
+func (expr andExpression) Match(tags []string) bool {
+	return expr.left.Match(tags) && expr.right.Match(tags)
+}
+
+func (expr andExpression) String() string {
+	return fmt.Sprintf("(%s and %s)", expr.left, expr.right)
+}
+
+func (expr orExpression) Match(tags []string) bool {
+	return expr.left.Match(tags) || expr.right.Match(tags)
+}
+
+func (expr orExpression) String() string {
+	return fmt.Sprintf("(%s or %s)", expr.left, expr.right)
+}
+
+type tokenKind int
+
+const (
+	tokenEnd tokenKind = iota
+	tokenTag
+	tokenAnd
+	tokenOr
+	tokenNot
+	tokenOpen
+	tokenClose
+)
+
+type token struct {
+	kind     tokenKind
+	text     string
+	position int
+}
+
+func (t token) describe() string {
+	if t.kind == tokenEnd {
+		return "end of expression"
+	}
+	return fmt.Sprintf("%q", t.text)
+}
+
+type TagExpressionError struct {
+	Expression string
+	Position   int
+	Message    string
+}
+
+// The error message points out where in the expression parsing failed, e.g.
+//
+//	invalid tag expression: expected a tag, found ")" at position 10
+//	  prod and )
+//	           ^
+func (err TagExpressionError) Error() string {
+	return fmt.Sprintf("invalid tag expression: %s at position %d\n  %s\n  %s^",
+		err.Message, err.Position+1, err.Expression, strings.Repeat(" ", err.Position))
+}
+
+func isTagRune(r rune) bool {
+	return !unicode.IsSpace(r) && r != '(' && r != ')' && r != ','
+}
+
+func tokenize(expression string) (tokens []token) {
+	runes := []rune(expression)
+	for position := 0; position < len(runes); {
+		r := runes[position]
+		switch {
+		case unicode.IsSpace(r):
+			position++
+		case r == '(':
+			tokens = append(tokens, token{tokenOpen, "(", position})
+			position++
+		case r == ')':
+			tokens = append(tokens, token{tokenClose, ")", position})
+			position++
+		case r == ',':
+			tokens = append(tokens, token{tokenAnd, ",", position})
+			position++
+		default:
+			start := position
+			for position < len(runes) && isTagRune(runes[position]) {
+				position++
+			}
+			text := string(runes[start:position])
+			kind := tokenTag
+			switch text {
+			case "and":
+				kind = tokenAnd
+			case "or":
+				kind = tokenOr
+			case "not":
+				kind = tokenNot
+			}
+			tokens = append(tokens, token{kind, text, start})
+		}
+	}
+
+	return append(tokens, token{tokenEnd, "", len(runes)})
+}
+
+// Recursive descent parser for:
+//
+//	or      = and { "or" and }
+//	and     = not { ( "and" | "," ) not }
+//	not     = "not" not | primary
+//	primary = tag | "(" or ")"
+type tagParser struct {
+	expression string
+	tokens     []token
+	position   int
+}
+
+func (p *tagParser) peek() token {
+	return p.tokens[p.position]
+}
+
+func (p *tagParser) next() token {
+	t := p.tokens[p.position]
+	if t.kind != tokenEnd {
+		p.position++
+	}
+	return t
+}
+
+func (p *tagParser) errorAt(t token, format string, args ...interface{}) error {
+	return TagExpressionError{
+		Expression: p.expression,
+		Position:   t.position,
+		Message:    fmt.Sprintf(format, args...),
+	}
+}
+
+func (p *tagParser) parseOr() (TagExpression, error) {
+	left, err := p.parseAnd()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenOr {
+		p.next()
+		right, err := p.parseAnd()
+		if err != nil {
+			return nil, err
+		}
+		left = orExpression{left, right}
+	}
+	return left, nil
+}
+
+func (p *tagParser) parseAnd() (TagExpression, error) {
+	left, err := p.parseNot()
+	if err != nil {
+		return nil, err
+	}
+	for p.peek().kind == tokenAnd {
+		p.next()
+		right, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		left = andExpression{left, right}
+	}
+	return left, nil
+}
+
+func (p *tagParser) parseNot() (TagExpression, error) {
+	if p.peek().kind == tokenNot {
+		p.next()
+		operand, err := p.parseNot()
+		if err != nil {
+			return nil, err
+		}
+		return notExpression{operand}, nil
+	}
+	return p.parsePrimary()
+}
+
+func (p *tagParser) parsePrimary() (TagExpression, error) {
+	t := p.next()
+	switch t.kind {
+	case tokenTag:
+		return tagTerm(t.text), nil
+	case tokenOpen:
+		expr, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		closing := p.next()
+		if closing.kind != tokenClose {
+			return nil, p.errorAt(closing, "expected \")\" to close \"(\" at position %d, found %s", t.position+1, closing.describe())
+		}
+		return expr, nil
+	default:
+		return nil, p.errorAt(t, "expected a tag, found %s", t.describe())
+	}
+}
+
+func ParseTagExpression(expression string) (TagExpression, error) {
+	p := &tagParser{
+		expression: expression,
+		tokens:     tokenize(expression),
+	}
+
+	expr, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+
+	if t := p.peek(); t.kind != tokenEnd {
+		if t.kind == tokenClose {
+			return nil, p.errorAt(t, "unbalanced \")\"")
+		}
+		return nil, p.errorAt(t, "expected \"and\", \"or\" or end of expression, found %s", t.describe())
+	}
+
+	return expr, nil
+}
+
+// Select the hosts whose tags match the expression. A nil expression matches all hosts.
+func FilterHostsTagExpression(allHosts []nix.Host, expression TagExpression) (hosts []nix.Host) {
+	if expression == nil {
+		return allHosts
+	}
+
+	for _, host := range allHosts {
+		if expression.Match(host.GetTags()) {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return
+}
@@ -0,0 +1,115 @@
+package filter
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestParseTagExpression(t *testing.T) {
+	tests := []struct {
+		expression string
+		want       string
+	}{
+		{"prod", "prod"},
+		{"prod,master", "(prod and master)"},
+		// "and" (and ",") binds tighter than "or"
+		{"a,b or c", "((a and b) or c)"},
+		{"a or b and c", "(a or (b and c))"},
+		{"a or b, c", "(a or (b and c))"},
+		// "not" binds tighter than "and"
+		{"not a and b", "(not a and b)"},
+		{"not not x", "not not x"},
+		{"not (a or b)", "not (a or b)"},
+		{"(a or b) and c", "((a or b) and c)"},
+		{"((a))", "a"},
+		{"  a   and\tb ", "(a and b)"},
+		{"rack-17,db.eu", "(rack-17 and db.eu)"},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			expr, err := ParseTagExpression(test.expression)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if got := expr.String(); got != test.want {
+				t.Errorf("got %s, want %s", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseTagExpressionErrors(t *testing.T) {
+	tests := []struct {
+		expression string
+		position   int
+		message    string
+	}{
+		{"", 0, "expected a tag, found end of expression"},
+		{"   ", 3, "expected a tag, found end of expression"},
+		{"(a or b", 7, "expected \")\" to close \"(\" at position 1, found end of expression"},
+		{"((a)", 4, "expected \")\" to close \"(\" at position 1, found end of expression"},
+		{"a or b)", 6, "unbalanced \")\""},
+		{"(a))", 3, "unbalanced \")\""},
+		{"prod and )", 9, "expected a tag, found \")\""},
+		{"a and", 5, "expected a tag, found end of expression"},
+		{"not", 3, "expected a tag, found end of expression"},
+		{"a,,b", 2, "expected a tag, found \",\""},
+		{"a b", 2, "expected \"and\", \"or\" or end of expression, found \"b\""},
+		{"()", 1, "expected a tag, found \")\""},
+	}
+
+	for _, test := range tests {
+		t.Run(test.expression, func(t *testing.T) {
+			_, err := ParseTagExpression(test.expression)
+			if err == nil {
+				t.Fatal("expected an error")
+			}
+
+			var exprErr TagExpressionError
+			if !errors.As(err, &exprErr) {
+				t.Fatalf("expected a TagExpressionError, got %T: %s", err, err)
+			}
+			if exprErr.Position != test.position {
+				t.Errorf("got position %d, want %d", exprErr.Position, test.position)
+			}
+			if exprErr.Message != test.message {
+				t.Errorf("got message %q, want %q", exprErr.Message, test.message)
+			}
+		})
+	}
+}
+
+func TestTagExpressionMatch(t *testing.T) {
+	tests := []struct {
+		expression string
+		tags       []string
+		want       bool
+	}{
+		{"prod", []string{"prod"}, true},
+		{"prod", []string{"staging"}, false},
+		{"prod", nil, false},
+		{"prod,master", []string{"prod"}, false},
+		{"prod,master", []string{"master", "prod"}, true},
+		{"a,b or c", []string{"c"}, true},
+		{"a,b or c", []string{"a"}, false},
+		{"a,(b or c)", []string{"a", "c"}, true},
+		{"a,(b or c)", []string{"c"}, false},
+		{"not db", []string{"web"}, true},
+		{"not db", []string{"db"}, false},
+		{"not not x", []string{"x"}, true},
+		{"not not x", nil, false},
+		{"prod and not (db or rack-17)", []string{"prod", "web"}, true},
+		{"prod and not (db or rack-17)", []string{"prod", "rack-17"}, false},
+	}
+
+	for _, test := range tests {
+		expr, err := ParseTagExpression(test.expression)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.expression, err)
+		}
+		if got := expr.Match(test.tags); got != test.want {
+			t.Errorf("%s matching %v: got %t, want %t", test.expression, test.tags, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,71 @@
+package filter
+
+import (
+	"encoding/json"
+	"fmt"
+	"reflect"
+	"regexp"
+	"strings"
+
+	"github.com/DBCDK/morph/nix"
+)
+
+// A condition on an option of the evaluated host configuration, e.g. `services.postgresql.enable == true`
+type WhereCondition struct {
+	Attribute string
+	Operator  string
+	Value     interface{}
+}
+
+var whereConditionRegex = regexp.MustCompile(`^\s*([A-Za-z_][A-Za-z0-9_'-]*(?:\.[A-Za-z_][A-Za-z0-9_'-]*)*)\s*(==|!=)\s*(.*?)\s*$`)
+
+// Parse a condition of the form `<attribute path> == <value>` or `<attribute path> != <value>`.
+// The value is parsed as JSON (e.g. true, 42, null or "aarch64-linux"). Anything that isn't valid JSON
+// is compared as a plain string, so quotes can be left out of simple string values.
+func ParseWhereCondition(condition string) (where WhereCondition, err error) {
+	match := whereConditionRegex.FindStringSubmatch(condition)
+	if match == nil {
+		return where, fmt.Errorf("Invalid condition %q: expected `<attribute> == <value>` or `<attribute> != <value>`, e.g. `services.nginx.enable == true`", condition)
+	}
+	if match[3] == "" {
+		return where, fmt.Errorf("Invalid condition %q: missing value after %s", condition, match[2])
+	}
+
+	where = WhereCondition{
+		Attribute: match[1],
+		Operator:  match[2],
+	}
+
+	if err := json.Unmarshal([]byte(match[3]), &where.Value); err != nil {
+		where.Value = match[3]
+	}
+
+	return where, nil
+}
+
+func (where WhereCondition) Match(value interface{}) bool {
+	equal := reflect.DeepEqual(value, where.Value)
+	if where.Operator == "!=" {
+		return !equal
+	}
+	return equal
+}
+
+func (where WhereCondition) String() string {
+	value, err := json.Marshal(where.Value)
+	if err != nil {
+		return fmt.Sprintf("%s %s %v", where.Attribute, where.Operator, where.Value)
+	}
+	return strings.Join([]string{where.Attribute, where.Operator, string(value)}, " ")
+}
+
+// Select the hosts whose value of the condition's attribute (as evaluated for each host) matches the condition.
+func FilterHostsWhere(allHosts []nix.Host, where WhereCondition, values map[string]interface{}) (hosts []nix.Host) {
+	for _, host := range allHosts {
+		if where.Match(values[host.Name]) {
+			hosts = append(hosts, host)
+		}
+	}
+
+	return
+}
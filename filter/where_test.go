@@ -0,0 +1,123 @@
+package filter
+
+import (
+	"reflect"
+	"testing"
+
+	"github.com/DBCDK/morph/nix"
+)
+
+func TestParseWhereCondition(t *testing.T) {
+	tests := []struct {
+		condition string
+		want      WhereCondition
+	}{
+		{"services.nginx.enable == true", WhereCondition{"services.nginx.enable", "==", true}},
+		{"services.nginx.enable!=false", WhereCondition{"services.nginx.enable", "!=", false}},
+		{"  boot.loader.timeout == 5  ", WhereCondition{"boot.loader.timeout", "==", float64(5)}},
+		{"nixpkgs.system == \"aarch64-linux\"", WhereCondition{"nixpkgs.system", "==", "aarch64-linux"}},
+		// values which aren't valid JSON are compared as plain strings
+		{"nixpkgs.system == aarch64-linux", WhereCondition{"nixpkgs.system", "==", "aarch64-linux"}},
+		{"networking.domain == null", WhereCondition{"networking.domain", "==", nil}},
+		{"networking.nameservers == [\"1.1.1.1\"]", WhereCondition{"networking.nameservers", "==", []interface{}{"1.1.1.1"}}},
+		{"services.foo-bar.enable' == true", WhereCondition{"services.foo-bar.enable'", "==", true}},
+	}
+
+	for _, test := range tests {
+		t.Run(test.condition, func(t *testing.T) {
+			got, err := ParseWhereCondition(test.condition)
+			if err != nil {
+				t.Fatalf("unexpected error: %s", err)
+			}
+			if !reflect.DeepEqual(got, test.want) {
+				t.Errorf("got %#v, want %#v", got, test.want)
+			}
+		})
+	}
+}
+
+func TestParseWhereConditionErrors(t *testing.T) {
+	tests := []string{
+		"",
+		"services.nginx.enable",
+		"services.nginx.enable = true",
+		"services.nginx.enable ==",
+		"== true",
+		".services == true",
+		"services..nginx == true",
+		"1services == true",
+	}
+
+	for _, condition := range tests {
+		if where, err := ParseWhereCondition(condition); err == nil {
+			t.Errorf("%q: expected an error, got %#v", condition, where)
+		}
+	}
+}
+
+func TestWhereConditionMatch(t *testing.T) {
+	tests := []struct {
+		condition string
+		value     interface{}
+		want      bool
+	}{
+		{"a == true", true, true},
+		{"a == true", false, false},
+		{"a == true", nil, false},
+		{"a != true", false, true},
+		{"a != true", nil, true},
+		{"a == 5", float64(5), true},
+		{"a == 5", "5", false},
+		{"a == x86_64-linux", "x86_64-linux", true},
+		{"a == null", nil, true},
+		{"a != null", "", true},
+		{"a == [1, 2]", []interface{}{float64(1), float64(2)}, true},
+		{"a == [1, 2]", []interface{}{float64(2), float64(1)}, false},
+	}
+
+	for _, test := range tests {
+		where, err := ParseWhereCondition(test.condition)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.condition, err)
+		}
+		if got := where.Match(test.value); got != test.want {
+			t.Errorf("%s with value %#v: got %t, want %t", test.condition, test.value, got, test.want)
+		}
+	}
+}
+
+func TestFilterHostsWhere(t *testing.T) {
+	hosts := []nix.Host{{Name: "web01"}, {Name: "web02"}, {Name: "db01"}}
+	values := map[string]interface{}{
+		"web01": true,
+		"web02": false,
+		// db01 has no value, e.g. because the option doesn't exist on it
+	}
+
+	tests := []struct {
+		condition string
+		want      []string
+	}{
+		{"services.nginx.enable == true", []string{"web01"}},
+		{"services.nginx.enable != true", []string{"web02", "db01"}},
+		{"services.nginx.enable == null", []string{"db01"}},
+		{"services.nginx.enable == \"yes\"", nil},
+	}
+
+	for _, test := range tests {
+		where, err := ParseWhereCondition(test.condition)
+		if err != nil {
+			t.Fatalf("%s: unexpected error: %s", test.condition, err)
+		}
+		if got := hostNames(FilterHostsWhere(hosts, where, values)); !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %v, want %v", test.condition, got, test.want)
+		}
+	}
+}
+
+func hostNames(hosts []nix.Host) (names []string) {
+	for _, host := range hosts {
+		names = append(names, host.Name)
+	}
+	return
+}
@@ -0,0 +1,106 @@
+package healthchecks
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+func containsInt(values []int, value int) bool {
+	for _, v := range values {
+		if v == value {
+			return true
+		}
+	}
+	return false
+}
+
+func sortedKeys(m map[string]string) []string {
+	keys := make([]string, 0, len(m))
+	for key := range m {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+func assertHeaders(headers http.Header, expected map[string]string) error {
+	for _, name := range sortedKeys(expected) {
+		if value := headers.Get(name); value != expected[name] {
+			return fmt.Errorf("Header %s: expected %q, got %q", name, expected[name], value)
+		}
+	}
+	return nil
+}
+
+func assertBody(body []byte, expectBody string, expectBodyRegex string, expectJson map[string]string) error {
+	if expectBody != "" && !strings.Contains(string(body), expectBody) {
+		return fmt.Errorf("Response body doesn't contain %q", expectBody)
+	}
+
+	if expectBodyRegex != "" {
+		re, err := regexp.Compile(expectBodyRegex)
+		if err != nil {
+			return fmt.Errorf("Invalid body regex %q: %s", expectBodyRegex, err)
+		}
+		if !re.Match(body) {
+			return fmt.Errorf("Response body doesn't match %q", expectBodyRegex)
+		}
+	}
+
+	if len(expectJson) == 0 {
+		return nil
+	}
+
+	var document interface{}
+	if err := json.Unmarshal(body, &document); err != nil {
+		return fmt.Errorf("Response body isn't valid JSON: %s", err)
+	}
+
+	for _, path := range sortedKeys(expectJson) {
+		value, err := lookupJsonPath(document, path)
+		if err != nil {
+			return err
+		}
+		if value != expectJson[path] {
+			return fmt.Errorf("JSON %s: expected %s, got %s", path, expectJson[path], value)
+		}
+	}
+
+	return nil
+}
+
+// Look up a dot separated path (e.g. "checks.0.status") in a decoded JSON document.
+// Strings are returned as is, everything else as JSON (e.g. `true`, `42` or `null`).
+func lookupJsonPath(document interface{}, path string) (string, error) {
+	current := document
+	for _, element := range strings.Split(path, ".") {
+		switch node := current.(type) {
+		case map[string]interface{}:
+			value, ok := node[element]
+			if !ok {
+				return "", fmt.Errorf("JSON %s: key %q not found", path, element)
+			}
+			current = value
+		case []interface{}:
+			index, err := strconv.Atoi(element)
+			if err != nil || index < 0 || index >= len(node) {
+				return "", fmt.Errorf("JSON %s: invalid index %q", path, element)
+			}
+			current = node[index]
+		default:
+			return "", fmt.Errorf("JSON %s: can't look up %q in a scalar value", path, element)
+		}
+	}
+
+	if value, ok := current.(string); ok {
+		return value, nil
+	}
+
+	value, err := json.Marshal(current)
+	return string(value), err
+}
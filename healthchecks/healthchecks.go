@@ -1,78 +1,344 @@
 package healthchecks
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/DBCDK/morph/events"
 	"github.com/DBCDK/morph/ssh"
-	"os"
+	"github.com/DBCDK/morph/utils"
+	"io"
+	"strings"
 	"sync"
 	"time"
 )
 
-func PerformChecks(sshContext *ssh.SSHContext, checkName string, host Host, healthChecks HealthChecks, timeout int) (err error) {
-	fmt.Fprintf(os.Stderr, "Running %s on %s (%s):\n", checkName, host.GetName(), host.GetTargetHost())
+// Run health checks concurrently until they have all succeeded. All outstanding checks are cancelled
+// (including their ssh processes) once the timeout is reached, ctx is cancelled or one of the checks fails.
+// PerformChecks doesn't return before every check has stopped. The returned report contains every attempt
+// of every check, regardless of the outcome. Progress is written to out.
+func PerformChecks(ctx context.Context, out io.Writer, sshContext *ssh.SSHContext, checkName string, host Host, healthChecks HealthChecks, timeout int) (report CheckReport, err error) {
+	defer utils.TrackWork()()
+
+	// checks write their progress concurrently
+	out = &syncWriter{writer: out}
+	events.EmitTo(out, events.Event{
+		Type:    events.Message,
+		Host:    host.GetName(),
+		Message: fmt.Sprintf("Running %s on %s (%s):\n", checkName, host.GetName(), host.GetTargetHost()),
+	})
+
+	start := time.Now()
+	report = CheckReport{
+		Host: host.GetName(),
+		Name: checkName,
+	}
+	defer func() {
+		report.Duration = time.Since(start).Seconds()
+		report.Status = StatusPassed
+		if err != nil {
+			report.Status = StatusFailed
+			report.Error = err.Error()
+		}
+	}()
+
+	checks := healthChecks.list(sshContext)
+	dependencies, err := resolveDependencies(checks)
+	if err != nil {
+		return report, err
+	}
+
+	report.Checks = make([]CheckResult, len(checks))
+	for index, healthCheck := range checks {
+		report.Checks[index] = CheckResult{
+			Description: healthCheck.GetDescription(),
+			Type:        checkType(healthCheck),
+			Status:      StatusSkipped,
+			Attempts:    []CheckAttempt{},
+		}
+	}
+
+	checksCtx, cancel := utils.ContextWithConditionalTimeout(ctx, timeout)
+	defer cancel()
 
 	wg := sync.WaitGroup{}
-	for _, healthCheck := range healthChecks.Cmd {
+	failures := make([]string, len(checks))
+	succeeded := make([]bool, len(checks))
+	done := make([]chan struct{}, len(checks))
+	for index := range checks {
+		done[index] = make(chan struct{})
+	}
+	for index, healthCheck := range checks {
 		wg.Add(1)
+		go func(index int, healthCheck HealthCheck) {
+			defer wg.Done()
+			defer close(done[index])
+
+			// wait for the checks this one is ordered after. A failing dependency cancels all checks anyway.
+			for _, dependency := range dependencies[index] {
+				select {
+				case <-done[dependency]:
+				case <-checksCtx.Done():
+					return
+				}
+				if !succeeded[dependency] {
+					return
+				}
+			}
+
+			result := &report.Checks[index]
+			checkStart := time.Now()
+			err := runCheckUntilSuccess(checksCtx, out, host, healthCheck, result)
+			result.Duration = time.Since(checkStart).Seconds()
+
+			switch {
+			case err == nil:
+				result.Status = StatusPassed
+			case checksCtx.Err() != nil:
+				// checks stopped because of the timeout or a failing sibling aren't failures on their own
+				result.Status = StatusCancelled
+				result.LastError = err.Error()
+			default:
+				result.Status = StatusFailed
+				result.LastError = err.Error()
+				failures[index] = fmt.Sprintf("%s: %s", healthCheck.GetDescription(), err)
+				cancel()
+			}
+			succeeded[index] = err == nil
+		}(index, healthCheck)
+	}
+
+	wg.Wait()
+
+	var failed []string
+	for _, failure := range failures {
+		if failure != "" {
+			failed = append(failed, failure)
+		}
+	}
+	if len(failed) > 0 {
+		emitFinished(out, host, checkName, StatusFailed, fmt.Sprintf("%s failed\n", checkName))
+		return report, fmt.Errorf("%s failed on %s:\n\t%s", checkName, host.GetName(), strings.Join(failed, "\n\t"))
+	}
+
+	if ctx.Err() != nil {
+		emitFinished(out, host, checkName, StatusCancelled, fmt.Sprintf("Cancelled: Stopped waiting for %s to complete\n", checkName))
+		return report, fmt.Errorf("%s on %s cancelled", checkName, host.GetName())
+	}
+
+	if checksCtx.Err() != nil {
+		emitFinished(out, host, checkName, "timeout", fmt.Sprintf("Timeout: Gave up waiting for %s to complete after %d seconds\n", checkName, timeout))
+		return report, errors.New(fmt.Sprintf("timeout running %s on %s", checkName, host.GetName()))
+	}
+
+	emitFinished(out, host, checkName, StatusPassed, checkName+" OK\n")
+	return report, nil
+}
+
+func PerformPreDeployChecks(ctx context.Context, out io.Writer, sshContext *ssh.SSHContext, host Host, timeout int) (report CheckReport, err error) {
+	return PerformChecks(ctx, out, sshContext, "pre-deploy checks", host, host.GetPreDeployChecks(), timeout)
+}
+
+func PerformHealthChecks(ctx context.Context, out io.Writer, sshContext *ssh.SSHContext, host Host, timeout int) (report CheckReport, err error) {
+	return PerformChecks(ctx, out, sshContext, "health checks", host, host.GetHealthChecks(), timeout)
+}
+
+// All health checks as a single list, grouped by type
+func (healthChecks HealthChecks) list(sshContext *ssh.SSHContext) (checks []HealthCheck) {
+	for _, healthCheck := range healthChecks.Cmd {
 		healthCheck.SshContext = sshContext
-		go runCheckUntilSuccess(host, healthCheck, &wg)
+		checks = append(checks, healthCheck)
 	}
 	for _, healthCheck := range healthChecks.Http {
-		wg.Add(1)
-		go runCheckUntilSuccess(host, healthCheck, &wg)
+		checks = append(checks, healthCheck)
+	}
+	for _, healthCheck := range healthChecks.Tcp {
+		checks = append(checks, healthCheck)
+	}
+	for _, healthCheck := range healthChecks.Systemd {
+		healthCheck.SshContext = sshContext
+		checks = append(checks, healthCheck)
+	}
+	for _, healthCheck := range healthChecks.Local {
+		checks = append(checks, healthCheck)
+	}
+	for _, healthCheck := range healthChecks.Prometheus {
+		checks = append(checks, healthCheck)
 	}
 
-	doneChan := make(chan bool)
+	return checks
+}
 
-	go func() {
-		wg.Wait()
-		doneChan <- true
-	}()
+type syncWriter struct {
+	mu     sync.Mutex
+	writer io.Writer
+}
 
-	// send timeout signal eventually
-	timeoutChan := make(chan bool)
-	if timeout > 0 {
-		go func() {
-			time.Sleep(time.Duration(timeout) * time.Second)
-			timeoutChan <- true
-		}()
-	}
-
-	// run checks until done or timeout reached. Failing health checks will add themself to the chan again
-	done := false
-	for !done {
-		select {
-		case <-doneChan:
-			fmt.Fprintln(os.Stderr, checkName+" OK")
-			done = true
-		case <-timeoutChan:
-			fmt.Fprintf(os.Stderr, "Timeout: Gave up waiting for %s to complete after %d seconds\n", checkName, timeout)
-			return errors.New(fmt.Sprintf("timeout running %s on %s", checkName, host.GetName()))
-		}
+func (w *syncWriter) Write(p []byte) (int, error) {
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	return w.writer.Write(p)
+}
+
+func emitAttempt(out io.Writer, host Host, healthCheck HealthCheck, attempt int, err error, message string) {
+	data := map[string]interface{}{
+		"check":   healthCheck.GetDescription(),
+		"type":    checkType(healthCheck),
+		"attempt": attempt,
+		"status":  StatusPassed,
+	}
+	if err != nil {
+		data["status"] = StatusFailed
+		data["error"] = err.Error()
 	}
 
-	return nil
+	events.EmitTo(out, events.Event{
+		Type:    events.CheckAttempt,
+		Host:    host.GetName(),
+		Message: message,
+		Data:    data,
+	})
 }
 
-func PerformPreDeployChecks(sshContext *ssh.SSHContext, host Host, timeout int) (err error) {
-	return PerformChecks(sshContext, "pre-deploy checks", host, host.GetPreDeployChecks(), timeout)
+// The final result of a check. Passing checks are only reported as an event, since the last attempt
+// already says so in the text output.
+func emitResult(out io.Writer, host Host, healthCheck HealthCheck, status string, err error) {
+	event := events.Event{
+		Type: events.CheckResult,
+		Host: host.GetName(),
+		Data: map[string]interface{}{
+			"check":  healthCheck.GetDescription(),
+			"type":   checkType(healthCheck),
+			"status": status,
+		},
+	}
+	if err != nil {
+		event.Message = fmt.Sprintf("\t* %s: Giving up (%s)\n", healthCheck.GetDescription(), err)
+		event.Data["error"] = err.Error()
+	}
+
+	events.EmitTo(out, event)
 }
 
-func PerformHealthChecks(sshContext *ssh.SSHContext, host Host, timeout int) (err error) {
-	return PerformChecks(sshContext, "health checks", host, host.GetHealthChecks(), timeout)
+func emitFinished(out io.Writer, host Host, checkName string, status string, message string) {
+	events.EmitTo(out, events.Event{
+		Type:    events.ChecksFinished,
+		Host:    host.GetName(),
+		Message: message,
+		Data: map[string]interface{}{
+			"checks": checkName,
+			"status": status,
+		},
+	})
 }
 
-func runCheckUntilSuccess(host Host, healthCheck HealthCheck, wg *sync.WaitGroup) {
-	for {
-		err := healthCheck.Run(host)
+// Sleep for the given duration, or until ctx is cancelled
+func sleep(ctx context.Context, duration time.Duration) error {
+	timer := time.NewTimer(duration)
+	defer timer.Stop()
+
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Run a health check until it succeeds, or until its retry policy gives up on it.
+// The error returned in the latter case includes the reason the last attempt failed.
+// Each attempt is recorded in result.
+func runCheckUntilSuccess(ctx context.Context, out io.Writer, host Host, healthCheck HealthCheck, result *CheckResult) error {
+	policy := healthCheck.GetRetryPolicy()
+	period := time.Duration(healthCheck.GetPeriod()) * time.Second
+
+	successThreshold := policy.SuccessThreshold
+	if successThreshold < 1 {
+		successThreshold = 1
+	}
+
+	if err := sleep(ctx, time.Duration(policy.InitialDelay)*time.Second); err != nil {
+		return err
+	}
+
+	// the deadline also interrupts an attempt in progress
+	checkCtx := ctx
+	var deadline time.Time
+	if policy.Deadline > 0 {
+		deadline = time.Now().Add(time.Duration(policy.Deadline) * time.Second)
+		var cancel context.CancelFunc
+		checkCtx, cancel = context.WithDeadline(ctx, deadline)
+		defer cancel()
+	}
+
+	// consecutive successes and failures
+	successes := 0
+	failures := 0
+	var lastErr error
+
+	for attempt := 1; ; attempt++ {
+		attemptStart := time.Now()
+		err := healthCheck.Run(checkCtx, host)
+		if ctx.Err() != nil {
+			// keep the attempt that was in progress, since it's usually why the checks timed out
+			result.addAttempt(attemptStart, err)
+			if err != nil {
+				lastErr = err
+			}
+			return cancelled(ctx, lastErr)
+		}
+		interrupted := err != nil && checkCtx.Err() != nil
+		result.addAttempt(attemptStart, err)
 		if err == nil {
-			fmt.Fprintf(os.Stderr, "\t* %s: OK\n", healthCheck.GetDescription())
-			break
+			successes++
+			failures = 0
+			if successes >= successThreshold {
+				emitAttempt(out, host, healthCheck, attempt, nil, fmt.Sprintf("\t* %s: OK\n", healthCheck.GetDescription()))
+				emitResult(out, host, healthCheck, StatusPassed, nil)
+				return nil
+			}
+			emitAttempt(out, host, healthCheck, attempt, nil, fmt.Sprintf("\t* %s: Passed (%d/%d)\n", healthCheck.GetDescription(), successes, successThreshold))
+		} else {
+			successes = 0
+			failures++
+			// the error of an interrupted attempt is only about the interruption
+			if !interrupted || lastErr == nil {
+				lastErr = err
+			}
+			emitAttempt(out, host, healthCheck, attempt, err, fmt.Sprintf("\t* %s: Failed (%s)\n", healthCheck.GetDescription(), err))
+		}
+
+		var reason string
+		if interrupted {
+			reason = fmt.Sprintf("deadline of %ds exceeded during attempt %d", policy.Deadline, attempt)
+		} else if policy.FailureThreshold > 0 && failures >= policy.FailureThreshold {
+			reason = fmt.Sprintf("failed %d times in a row", failures)
+		} else if policy.MaxAttempts > 0 && attempt >= policy.MaxAttempts {
+			reason = fmt.Sprintf("gave up after %d attempts", attempt)
+		} else if !deadline.IsZero() && time.Now().Add(period).After(deadline) {
+			reason = fmt.Sprintf("deadline of %ds exceeded after %d attempts", policy.Deadline, attempt)
+		} else {
+			if err := sleep(ctx, period); err != nil {
+				return cancelled(ctx, lastErr)
+			}
+			continue
+		}
+
+		if successes > 0 {
+			err = fmt.Errorf("%s, only passed %d of %d consecutive times required", reason, successes, successThreshold)
 		} else {
-			fmt.Fprintf(os.Stderr, "\t* %s: Failed (%s)\n", healthCheck.GetDescription(), err)
-			time.Sleep(time.Duration(healthCheck.GetPeriod()) * time.Second)
+			err = fmt.Errorf("%s, last error: %s", reason, lastErr)
 		}
+
+		emitResult(out, host, healthCheck, StatusFailed, err)
+		return err
+	}
+}
+
+// The error of a check which was cancelled, including why its last failed attempt failed
+func cancelled(ctx context.Context, lastErr error) error {
+	if lastErr == nil {
+		return ctx.Err()
 	}
-	wg.Done()
+	return fmt.Errorf("%s, last error: %s", ctx.Err(), lastErr)
 }
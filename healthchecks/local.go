@@ -0,0 +1,58 @@
+package healthchecks
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"os/exec"
+
+	"github.com/DBCDK/morph/utils"
+)
+
+// A command health check run on the host running morph, rather than on the target host
+type LocalHealthCheck struct {
+	RetryPolicy
+	Ordering
+	Description string
+	Cmd         []string
+	Period      int
+	Timeout     int
+}
+
+func (healthCheck LocalHealthCheck) GetDescription() string {
+	return healthCheck.Description
+}
+
+func (healthCheck LocalHealthCheck) GetPeriod() int {
+	return healthCheck.Period
+}
+
+func (healthCheck LocalHealthCheck) Run(ctx context.Context, host Host) error {
+	if len(healthCheck.Cmd) == 0 {
+		return errors.New("error: No command specified")
+	}
+
+	ctx, cancel := utils.ContextWithConditionalTimeout(ctx, healthCheck.Timeout)
+	defer cancel()
+
+	cmd := exec.CommandContext(ctx, healthCheck.Cmd[0], healthCheck.Cmd[1:]...)
+	cmd.Env = append(os.Environ(),
+		"MORPH_HOST_NAME="+host.GetName(),
+		"MORPH_TARGET_HOST="+host.GetTargetHost(),
+		fmt.Sprintf("MORPH_TARGET_PORT=%d", host.GetTargetPort()),
+		"MORPH_TARGET_USER="+host.GetTargetUser(),
+	)
+
+	data, err := cmd.CombinedOutput()
+	if ctx.Err() != nil {
+		errorMessage := fmt.Sprintf("Timeout after %ds", healthCheck.Timeout)
+		return errors.New(errorMessage)
+	}
+	if err != nil {
+		errorMessage := fmt.Sprintf("output: %s", string(data))
+		return errors.New(errorMessage)
+	}
+
+	return nil
+}
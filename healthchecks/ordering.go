@@ -0,0 +1,73 @@
+package healthchecks
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Embedded in health checks that can be ordered after other health checks
+type Ordering struct {
+	After []string
+}
+
+func (ordering Ordering) GetAfter() []string {
+	return ordering.After
+}
+
+// Resolve the `after` references of each check to the indices of the checks it has to wait for.
+// References to unknown checks and dependency cycles are rejected. These are normally caught when
+// evaluating the deployment already, but are checked here as well, since a cycle would otherwise
+// make the checks wait for each other forever.
+func resolveDependencies(checks []HealthCheck) (dependencies [][]int, err error) {
+	byDescription := make(map[string][]int)
+	for index, healthCheck := range checks {
+		byDescription[healthCheck.GetDescription()] = append(byDescription[healthCheck.GetDescription()], index)
+	}
+
+	dependencies = make([][]int, len(checks))
+	for index, healthCheck := range checks {
+		for _, after := range healthCheck.GetAfter() {
+			indices, ok := byDescription[after]
+			if !ok {
+				return nil, fmt.Errorf("Health check %q is ordered after unknown health check %q", healthCheck.GetDescription(), after)
+			}
+			dependencies[index] = append(dependencies[index], indices...)
+		}
+	}
+
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(checks))
+	var path []string
+
+	var visit func(index int) error
+	visit = func(index int) error {
+		switch state[index] {
+		case visiting:
+			return fmt.Errorf("Health checks have a dependency cycle: %s -> %s", strings.Join(path, " -> "), checks[index].GetDescription())
+		case visited:
+			return nil
+		}
+		state[index] = visiting
+		path = append(path, checks[index].GetDescription())
+		for _, dependency := range dependencies[index] {
+			if err := visit(dependency); err != nil {
+				return err
+			}
+		}
+		path = path[:len(path)-1]
+		state[index] = visited
+		return nil
+	}
+
+	for index := range checks {
+		if err = visit(index); err != nil {
+			return nil, err
+		}
+	}
+
+	return dependencies, nil
+}
@@ -0,0 +1,213 @@
+package healthchecks
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"text/template"
+	"time"
+)
+
+// A health check querying a Prometheus compatible HTTP API, passing when every sample in the result
+// satisfies the comparison
+type PrometheusHealthCheck struct {
+	RetryPolicy
+	Ordering
+	Description string
+	Url         string
+	Query       string
+	Comparison  string
+	Value       float64
+	PassOnEmpty bool
+	Headers     map[string]string
+	InsecureSSL bool
+	Period      int
+	Timeout     int
+}
+
+// Data available to templated Prometheus queries
+type PrometheusQueryData struct {
+	Name       string
+	TargetHost string
+	TargetPort int
+	TargetUser string
+}
+
+type prometheusResponse struct {
+	Status string
+	Error  string
+	Data   struct {
+		ResultType string
+		Result     json.RawMessage
+	}
+}
+
+type prometheusSample struct {
+	Metric map[string]string
+	Value  []interface{}
+}
+
+var prometheusComparisons = map[string]func(a, b float64) bool{
+	"<":  func(a, b float64) bool { return a < b },
+	"<=": func(a, b float64) bool { return a <= b },
+	"==": func(a, b float64) bool { return a == b },
+	"!=": func(a, b float64) bool { return a != b },
+	">=": func(a, b float64) bool { return a >= b },
+	">":  func(a, b float64) bool { return a > b },
+}
+
+func (healthCheck PrometheusHealthCheck) GetDescription() string {
+	return healthCheck.Description
+}
+
+func (healthCheck PrometheusHealthCheck) GetPeriod() int {
+	return healthCheck.Period
+}
+
+func (healthCheck PrometheusHealthCheck) Run(ctx context.Context, host Host) error {
+	compare, ok := prometheusComparisons[healthCheck.Comparison]
+	if !ok {
+		return fmt.Errorf("Unknown comparison %q", healthCheck.Comparison)
+	}
+
+	query, err := healthCheck.renderQuery(host)
+	if err != nil {
+		return err
+	}
+
+	// http.Client interprets a timeout of 0 as "no timeout", but we still have to avoid passing
+	// a negative timeout to it
+	if healthCheck.Timeout < 0 {
+		healthCheck.Timeout = 0
+	}
+
+	tlsConfig, err := TLSOptions{InsecureSSL: healthCheck.InsecureSSL}.Config()
+	if err != nil {
+		return err
+	}
+
+	client := &http.Client{
+		Timeout:   time.Duration(healthCheck.Timeout) * time.Second,
+		Transport: &http.Transport{TLSClientConfig: tlsConfig, DisableKeepAlives: true},
+	}
+
+	queryUrl := strings.TrimSuffix(healthCheck.Url, "/") + "/api/v1/query?" + url.Values{"query": {query}}.Encode()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, queryUrl, nil)
+	if err != nil {
+		return err
+	}
+	for headerKey, headerValue := range healthCheck.Headers {
+		req.Header.Add(headerKey, headerValue)
+	}
+
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	body, err := io.ReadAll(io.LimitReader(resp.Body, httpMaxResponseSize))
+	if err != nil {
+		return err
+	}
+
+	var response prometheusResponse
+	if err = json.Unmarshal(body, &response); err != nil {
+		return fmt.Errorf("Invalid response from Prometheus (%s): %s", resp.Status, err)
+	}
+	if response.Status != "success" {
+		return fmt.Errorf("Query failed (%s): %s", resp.Status, response.Error)
+	}
+
+	samples, err := parsePrometheusResult(response.Data.ResultType, response.Data.Result)
+	if err != nil {
+		return err
+	}
+
+	if len(samples) == 0 {
+		if healthCheck.PassOnEmpty {
+			return nil
+		}
+		return fmt.Errorf("Query returned no samples: %s", query)
+	}
+
+	for _, sample := range samples {
+		if !compare(sample.value, healthCheck.Value) {
+			return fmt.Errorf("%s%s = %g, expected %s %g", sample.labels, query, sample.value, healthCheck.Comparison, healthCheck.Value)
+		}
+	}
+
+	return nil
+}
+
+func (healthCheck PrometheusHealthCheck) renderQuery(host Host) (string, error) {
+	tmpl, err := template.New("query").Option("missingkey=error").Parse(healthCheck.Query)
+	if err != nil {
+		return "", err
+	}
+
+	var query bytes.Buffer
+	err = tmpl.Execute(&query, PrometheusQueryData{
+		Name:       host.GetName(),
+		TargetHost: host.GetTargetHost(),
+		TargetPort: host.GetTargetPort(),
+		TargetUser: host.GetTargetUser(),
+	})
+
+	return query.String(), err
+}
+
+type parsedSample struct {
+	labels string
+	value  float64
+}
+
+func parsePrometheusResult(resultType string, result json.RawMessage) (samples []parsedSample, err error) {
+	switch resultType {
+	case "scalar":
+		var value []interface{}
+		if err = json.Unmarshal(result, &value); err != nil {
+			return nil, err
+		}
+		sampleValue, err := parsePrometheusValue(value)
+		if err != nil {
+			return nil, err
+		}
+		return []parsedSample{{value: sampleValue}}, nil
+	case "vector":
+		var vector []prometheusSample
+		if err = json.Unmarshal(result, &vector); err != nil {
+			return nil, err
+		}
+		for _, sample := range vector {
+			sampleValue, err := parsePrometheusValue(sample.Value)
+			if err != nil {
+				return nil, err
+			}
+			labels, _ := json.Marshal(sample.Metric)
+			samples = append(samples, parsedSample{labels: string(labels) + " ", value: sampleValue})
+		}
+		return samples, nil
+	default:
+		return nil, fmt.Errorf("Unsupported result type %q, the query must return a scalar or an instant vector", resultType)
+	}
+}
+
+// Values are returned as [ <unix time>, "<value>" ]
+func parsePrometheusValue(value []interface{}) (float64, error) {
+	if len(value) != 2 {
+		return 0, errors.New("Invalid sample in response from Prometheus")
+	}
+	valueString, ok := value[1].(string)
+	if !ok {
+		return 0, errors.New("Invalid sample value in response from Prometheus")
+	}
+	return strconv.ParseFloat(valueString, 64)
+}
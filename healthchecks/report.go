@@ -0,0 +1,181 @@
+package healthchecks
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"strings"
+	"time"
+)
+
+const (
+	StatusPassed    = "passed"
+	StatusFailed    = "failed"
+	StatusCancelled = "cancelled"
+	StatusSkipped   = "skipped"
+)
+
+// Durations are in seconds
+type CheckAttempt struct {
+	Start    time.Time `json:"start"`
+	Duration float64   `json:"duration"`
+	Error    string    `json:"error,omitempty"`
+}
+
+type CheckResult struct {
+	Description string         `json:"description"`
+	Type        string         `json:"type"`
+	Status      string         `json:"status"`
+	Duration    float64        `json:"duration"`
+	Attempts    []CheckAttempt `json:"attempts"`
+	LastError   string         `json:"lastError,omitempty"`
+}
+
+// The outcome of running a set of checks (e.g. health checks or pre-deploy checks) on a host
+type CheckReport struct {
+	Host     string        `json:"host"`
+	Name     string        `json:"name"`
+	Status   string        `json:"status"`
+	Duration float64       `json:"duration"`
+	Error    string        `json:"error,omitempty"`
+	Checks   []CheckResult `json:"checks"`
+}
+
+func (result *CheckResult) addAttempt(start time.Time, err error) {
+	attempt := CheckAttempt{
+		Start:    start,
+		Duration: time.Since(start).Seconds(),
+	}
+	if err != nil {
+		attempt.Error = err.Error()
+	}
+	result.Attempts = append(result.Attempts, attempt)
+}
+
+func checkType(healthCheck HealthCheck) string {
+	switch healthCheck.(type) {
+	case CmdHealthCheck:
+		return "cmd"
+	case HttpHealthCheck:
+		return "http"
+	case TcpHealthCheck:
+		return "tcp"
+	case SystemdHealthCheck:
+		return "systemd"
+	case LocalHealthCheck:
+		return "local"
+	case PrometheusHealthCheck:
+		return "prometheus"
+	default:
+		return "unknown"
+	}
+}
+
+func WriteJSONReport(w io.Writer, reports []CheckReport) error {
+	encoder := json.NewEncoder(w)
+	encoder.SetIndent("", "  ")
+	return encoder.Encode(reports)
+}
+
+type junitTestSuites struct {
+	XMLName  xml.Name         `xml:"testsuites"`
+	Name     string           `xml:"name,attr"`
+	Tests    int              `xml:"tests,attr"`
+	Failures int              `xml:"failures,attr"`
+	Errors   int              `xml:"errors,attr"`
+	Skipped  int              `xml:"skipped,attr"`
+	Time     float64          `xml:"time,attr"`
+	Suites   []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name     string          `xml:"name,attr"`
+	Tests    int             `xml:"tests,attr"`
+	Failures int             `xml:"failures,attr"`
+	Errors   int             `xml:"errors,attr"`
+	Skipped  int             `xml:"skipped,attr"`
+	Time     float64         `xml:"time,attr"`
+	Error    *junitMessage   `xml:"error,omitempty"`
+	Cases    []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      float64       `xml:"time,attr"`
+	Failure   *junitMessage `xml:"failure,omitempty"`
+	Skipped   *junitMessage `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+}
+
+type junitMessage struct {
+	Message string `xml:"message,attr"`
+	Body    string `xml:",chardata"`
+}
+
+// Write reports as JUnit XML, with a test suite per host and set of checks, and a test case per check.
+// Every attempt of a check is listed in its system-out.
+func WriteJUnitReport(w io.Writer, reports []CheckReport) error {
+	suites := junitTestSuites{Name: "morph"}
+
+	for _, report := range reports {
+		suite := junitTestSuite{
+			Name: fmt.Sprintf("%s: %s", report.Host, report.Name),
+			Time: report.Duration,
+		}
+		for _, result := range report.Checks {
+			testCase := junitTestCase{
+				Name:      result.Description,
+				ClassName: fmt.Sprintf("%s.%s", report.Host, result.Type),
+				Time:      result.Duration,
+			}
+
+			var attempts strings.Builder
+			for index, attempt := range result.Attempts {
+				status := "OK"
+				if attempt.Error != "" {
+					status = "Failed: " + attempt.Error
+				}
+				fmt.Fprintf(&attempts, "attempt %d at %s (%.3fs): %s\n", index+1, attempt.Start.Format(time.RFC3339), attempt.Duration, status)
+			}
+			testCase.SystemOut = attempts.String()
+
+			switch result.Status {
+			case StatusFailed:
+				testCase.Failure = &junitMessage{Message: result.LastError, Body: attempts.String()}
+				suite.Failures++
+			case StatusCancelled, StatusSkipped:
+				testCase.Skipped = &junitMessage{Message: result.Status, Body: result.LastError}
+				suite.Skipped++
+			}
+
+			suite.Cases = append(suite.Cases, testCase)
+			suite.Tests++
+		}
+
+		// e.g. the checks timed out, or couldn't be started at all. The suite must still count as failed.
+		if report.Status == StatusFailed && suite.Failures == 0 {
+			suite.Error = &junitMessage{Message: report.Error}
+			suite.Errors++
+		}
+
+		suites.Suites = append(suites.Suites, suite)
+		suites.Tests += suite.Tests
+		suites.Failures += suite.Failures
+		suites.Errors += suite.Errors
+		suites.Skipped += suite.Skipped
+		suites.Time += suite.Time
+	}
+
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	encoder := xml.NewEncoder(w)
+	encoder.Indent("", "  ")
+	if err := encoder.Encode(suites); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
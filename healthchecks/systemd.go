@@ -0,0 +1,104 @@
+package healthchecks
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/DBCDK/morph/ssh"
+	"github.com/DBCDK/morph/utils"
+)
+
+type SystemdHealthCheck struct {
+	RetryPolicy
+	Ordering
+	SshContext    *ssh.SSHContext
+	Description   string
+	Units         []string
+	NoFailedUnits bool
+	JournalLines  int
+	Period        int
+	Timeout       int
+}
+
+func (healthCheck SystemdHealthCheck) GetDescription() string {
+	return healthCheck.Description
+}
+
+func (healthCheck SystemdHealthCheck) GetPeriod() int {
+	return healthCheck.Period
+}
+
+func (healthCheck SystemdHealthCheck) Run(ctx context.Context, host Host) error {
+	ctx, cancel := utils.ContextWithConditionalTimeout(ctx, healthCheck.Timeout)
+	defer cancel()
+
+	var unhealthy []string
+
+	if len(healthCheck.Units) > 0 {
+		// is-active prints the state of each unit on a separate line, and exits non-zero unless all are active
+		output, err := healthCheck.output(ctx, host, append([]string{"systemctl", "is-active", "--"}, healthCheck.Units...)...)
+		if ctx.Err() != nil {
+			return fmt.Errorf("Timeout after %ds", healthCheck.Timeout)
+		}
+		states := strings.Fields(output)
+		if len(states) != len(healthCheck.Units) {
+			return fmt.Errorf("error: unexpected output from systemctl is-active (%v): %q", err, output)
+		}
+		for index, unit := range healthCheck.Units {
+			if states[index] != "active" {
+				unhealthy = append(unhealthy, fmt.Sprintf("%s (%s)", unit, states[index]))
+			}
+		}
+	}
+
+	if healthCheck.NoFailedUnits {
+		output, err := healthCheck.output(ctx, host, "systemctl", "list-units", "--failed", "--no-legend", "--plain", "--no-pager")
+		if ctx.Err() != nil {
+			return fmt.Errorf("Timeout after %ds", healthCheck.Timeout)
+		}
+		if err != nil {
+			return fmt.Errorf("error: %s", err)
+		}
+		for _, line := range strings.Split(output, "\n") {
+			if fields := strings.Fields(line); len(fields) > 0 {
+				unhealthy = append(unhealthy, fmt.Sprintf("%s (failed)", fields[0]))
+			}
+		}
+	}
+
+	if len(unhealthy) == 0 {
+		return nil
+	}
+
+	var message strings.Builder
+	fmt.Fprintf(&message, "unhealthy units: %s", strings.Join(unhealthy, ", "))
+
+	if healthCheck.JournalLines > 0 {
+		for _, unit := range unhealthy {
+			unit = strings.Fields(unit)[0]
+			// the journal is only there to help debugging, so errors getting it are ignored
+			journal, _ := healthCheck.output(ctx, host, "journalctl", "--unit", unit, "--lines", fmt.Sprintf("%d", healthCheck.JournalLines), "--no-pager", "--quiet")
+			if journal = strings.TrimSpace(journal); journal != "" {
+				fmt.Fprintf(&message, "\n\t  --- %s ---\n\t  %s", unit, strings.ReplaceAll(journal, "\n", "\n\t  "))
+			}
+		}
+	}
+
+	return errors.New(message.String())
+}
+
+func (healthCheck SystemdHealthCheck) output(ctx context.Context, host Host, parts ...string) (string, error) {
+	cmd, err := healthCheck.SshContext.CmdContext(ctx, host, parts...)
+	if err != nil {
+		return "", err
+	}
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	err = cmd.Run()
+
+	return stdout.String(), err
+}
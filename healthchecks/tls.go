@@ -0,0 +1,75 @@
+package healthchecks
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/DBCDK/morph/utils"
+)
+
+type TLSOptions struct {
+	InsecureSSL bool
+	CaFile      string
+	ClientCert  string
+	ClientKey   string
+	ServerName  string
+}
+
+// Build a TLS client configuration. Files are read on every call, so renewed certificates are picked up
+// between attempts.
+func (options TLSOptions) Config() (*tls.Config, error) {
+	config := &tls.Config{
+		InsecureSkipVerify: options.InsecureSSL,
+		ServerName:         options.ServerName,
+	}
+
+	if options.CaFile != "" {
+		caCerts, err := os.ReadFile(options.CaFile)
+		if err != nil {
+			return nil, err
+		}
+		pool := x509.NewCertPool()
+		if !pool.AppendCertsFromPEM(caCerts) {
+			return nil, fmt.Errorf("No PEM encoded certificates found in %s", options.CaFile)
+		}
+		config.RootCAs = pool
+	}
+
+	if options.ClientCert != "" || options.ClientKey != "" {
+		if options.ClientCert == "" || options.ClientKey == "" {
+			return nil, errors.New("Both clientCert and clientKey must be set to use a client certificate")
+		}
+		certificate, err := tls.LoadX509KeyPair(options.ClientCert, options.ClientKey)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{certificate}
+	}
+
+	return config, nil
+}
+
+// Resolve the local certificate and key files of the HTTP checks relative to the directory of the deployment
+// file, like the sources of secrets, so checks don't depend on the directory morph is run from.
+func (healthChecks HealthChecks) ResolvePaths(deploymentWD string) HealthChecks {
+	resolve := func(path string) string {
+		if path == "" {
+			return path
+		}
+		return utils.GetAbsPathRelativeTo(path, deploymentWD)
+	}
+
+	httpChecks := make([]HttpHealthCheck, 0, len(healthChecks.Http))
+	for _, healthCheck := range healthChecks.Http {
+		healthCheck.CaFile = resolve(healthCheck.CaFile)
+		healthCheck.ClientCert = resolve(healthCheck.ClientCert)
+		healthCheck.ClientKey = resolve(healthCheck.ClientKey)
+		httpChecks = append(httpChecks, healthCheck)
+	}
+	healthChecks.Http = httpChecks
+
+	return healthChecks
+}
@@ -7,11 +7,21 @@ import (
 	"fmt"
 	"github.com/DBCDK/morph/ssh"
 	"github.com/DBCDK/morph/utils"
+	"io"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 )
 
+const (
+	// upper limit on how much of a response TCP health checks will read while looking for the expected response
+	tcpMaxResponseSize = 64 * 1024
+	// upper limit on how much of a response body HTTP health checks will read for assertions
+	httpMaxResponseSize = 1024 * 1024
+)
+
 type Host interface {
 	GetName() string
 	GetTargetHost() string
@@ -22,11 +32,37 @@ type Host interface {
 }
 
 type HealthChecks struct {
-	Http []HttpHealthCheck
-	Cmd  []CmdHealthCheck
+	Http       []HttpHealthCheck
+	Cmd        []CmdHealthCheck
+	Tcp        []TcpHealthCheck
+	Systemd    []SystemdHealthCheck
+	Local      []LocalHealthCheck
+	Prometheus []PrometheusHealthCheck
+}
+
+func (healthChecks HealthChecks) Count() int {
+	return len(healthChecks.Http) + len(healthChecks.Cmd) + len(healthChecks.Tcp) + len(healthChecks.Systemd) +
+		len(healthChecks.Local) + len(healthChecks.Prometheus)
+}
+
+// Limits on how long a health check is retried before it's considered failed, and how many consecutive
+// attempts must succeed before it's considered OK.
+// Zero values mean no limit, in which case the check is retried until it succeeds (or the overall timeout is reached).
+type RetryPolicy struct {
+	MaxAttempts      int
+	Deadline         int
+	InitialDelay     int
+	SuccessThreshold int
+	FailureThreshold int
+}
+
+func (policy RetryPolicy) GetRetryPolicy() RetryPolicy {
+	return policy
 }
 
 type CmdHealthCheck struct {
+	RetryPolicy
+	Ordering
 	SshContext  *ssh.SSHContext
 	Description string
 	Cmd         []string
@@ -35,6 +71,8 @@ type CmdHealthCheck struct {
 }
 
 type HttpHealthCheck struct {
+	RetryPolicy
+	Ordering
 	Description string
 	Headers     map[string]string
 	Host        *string
@@ -44,12 +82,40 @@ type HttpHealthCheck struct {
 	Scheme      string
 	Period      int
 	Timeout     int
+	Method      string
+	Body        string
+	// an empty list accepts any 2xx status code
+	ExpectStatus    []int
+	ExpectHeaders   map[string]string
+	ExpectBody      string
+	ExpectBodyRegex string
+	ExpectJson      map[string]string
+	CaFile          string
+	ClientCert      string
+	ClientKey       string
+	ServerName      string
+}
+
+type TcpHealthCheck struct {
+	RetryPolicy
+	Ordering
+	Description string
+	Host        *string
+	Port        int
+	Send        string
+	Expect      string
+	TLS         bool
+	InsecureSSL bool
+	Period      int
+	Timeout     int
 }
 
 type HealthCheck interface {
 	GetDescription() string
 	GetPeriod() int
-	Run(Host) error
+	GetRetryPolicy() RetryPolicy
+	GetAfter() []string
+	Run(context.Context, Host) error
 }
 
 func (healthCheck CmdHealthCheck) GetDescription() string {
@@ -60,8 +126,8 @@ func (healthCheck CmdHealthCheck) GetPeriod() int {
 	return healthCheck.Period
 }
 
-func (healthCheck CmdHealthCheck) Run(host Host) error {
-	ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), healthCheck.Timeout)
+func (healthCheck CmdHealthCheck) Run(ctx context.Context, host Host) error {
+	ctx, cancel := utils.ContextWithConditionalTimeout(ctx, healthCheck.Timeout)
 	defer cancel()
 
 	cmd, err := healthCheck.SshContext.CmdContext(ctx, host, healthCheck.Cmd...)
@@ -91,7 +157,7 @@ func (healthCheck HttpHealthCheck) GetPeriod() int {
 	return healthCheck.Period
 }
 
-func (healthCheck HttpHealthCheck) Run(host Host) error {
+func (healthCheck HttpHealthCheck) Run(ctx context.Context, host Host) error {
 	// use the hosts hostname if the healthCheck host is not set
 	if healthCheck.Host == nil {
 		replacementHostname := host.GetTargetHost()
@@ -104,17 +170,42 @@ func (healthCheck HttpHealthCheck) Run(host Host) error {
 		healthCheck.Timeout = 0
 	}
 
-	transport := &http.Transport{}
+	// a new transport is created for each attempt, so connections can't be reused anyway and
+	// would otherwise be left idle
+	transport := &http.Transport{DisableKeepAlives: true}
 
-	transport.TLSClientConfig = &tls.Config{InsecureSkipVerify: healthCheck.InsecureSSL}
+	tlsConfig, err := TLSOptions{
+		InsecureSSL: healthCheck.InsecureSSL,
+		CaFile:      healthCheck.CaFile,
+		ClientCert:  healthCheck.ClientCert,
+		ClientKey:   healthCheck.ClientKey,
+		ServerName:  healthCheck.ServerName,
+	}.Config()
+	if err != nil {
+		return err
+	}
+	transport.TLSClientConfig = tlsConfig
 
 	client := &http.Client{
 		Timeout:   time.Duration(healthCheck.Timeout) * time.Second,
 		Transport: transport,
 	}
 
+	method := healthCheck.Method
+	if method == "" {
+		method = http.MethodGet
+	}
+
+	var body io.Reader
+	if healthCheck.Body != "" {
+		body = strings.NewReader(healthCheck.Body)
+	}
+
 	url := fmt.Sprintf("%s://%s:%d%s", healthCheck.Scheme, *healthCheck.Host, healthCheck.Port, healthCheck.Path)
-	req, err := http.NewRequest("GET", url, nil)
+	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	if err != nil {
+		return err
+	}
 
 	for headerKey, headerValue := range healthCheck.Headers {
 		if strings.ToLower(headerKey) == "host" {
@@ -130,11 +221,111 @@ func (healthCheck HttpHealthCheck) Run(host Host) error {
 		return err
 	}
 
-	resp.Body.Close()
+	defer resp.Body.Close()
 
-	if resp.StatusCode >= 200 && resp.StatusCode < 300 {
+	if len(healthCheck.ExpectStatus) > 0 {
+		if !containsInt(healthCheck.ExpectStatus, resp.StatusCode) {
+			return fmt.Errorf("Got unexpected status code (%s), expected one of %v", resp.Status, healthCheck.ExpectStatus)
+		}
+	} else if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return errors.New(fmt.Sprintf("Got non 2xx status code (%s)", resp.Status))
+	}
+
+	if err = assertHeaders(resp.Header, healthCheck.ExpectHeaders); err != nil {
+		return err
+	}
+
+	if healthCheck.ExpectBody == "" && healthCheck.ExpectBodyRegex == "" && len(healthCheck.ExpectJson) == 0 {
 		return nil
+	}
+
+	respBody, err := io.ReadAll(io.LimitReader(resp.Body, httpMaxResponseSize))
+	if err != nil {
+		return err
+	}
+
+	return assertBody(respBody, healthCheck.ExpectBody, healthCheck.ExpectBodyRegex, healthCheck.ExpectJson)
+}
+
+func (healthCheck TcpHealthCheck) GetDescription() string {
+	return healthCheck.Description
+}
+
+func (healthCheck TcpHealthCheck) GetPeriod() int {
+	return healthCheck.Period
+}
+
+func (healthCheck TcpHealthCheck) Run(ctx context.Context, host Host) error {
+	// use the hosts hostname if the healthCheck host is not set
+	if healthCheck.Host == nil {
+		replacementHostname := host.GetTargetHost()
+		healthCheck.Host = &replacementHostname
+	}
+
+	ctx, cancel := utils.ContextWithConditionalTimeout(ctx, healthCheck.Timeout)
+	defer cancel()
+
+	address := net.JoinHostPort(*healthCheck.Host, strconv.Itoa(healthCheck.Port))
+
+	var (
+		conn net.Conn
+		err  error
+	)
+	if healthCheck.TLS {
+		dialer := &tls.Dialer{
+			Config: &tls.Config{
+				InsecureSkipVerify: healthCheck.InsecureSSL,
+				ServerName:         *healthCheck.Host,
+			},
+		}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
 	} else {
-		return errors.New(fmt.Sprintf("Got non 2xx status code (%s)", resp.Status))
+		dialer := &net.Dialer{}
+		conn, err = dialer.DialContext(ctx, "tcp", address)
+	}
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
 	}
+
+	// unblock reads and writes if the context is cancelled
+	stop := make(chan struct{})
+	defer close(stop)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-stop:
+		}
+	}()
+
+	if healthCheck.Send != "" {
+		if _, err = io.WriteString(conn, healthCheck.Send); err != nil {
+			return err
+		}
+	}
+
+	if healthCheck.Expect == "" {
+		return nil
+	}
+
+	// read until the expected response shows up, the connection is closed or the deadline is reached
+	var received []byte
+	buffer := make([]byte, 4096)
+	for len(received) < tcpMaxResponseSize {
+		n, err := conn.Read(buffer)
+		received = append(received, buffer[:n]...)
+		if strings.Contains(string(received), healthCheck.Expect) {
+			return nil
+		}
+		if err != nil {
+			return fmt.Errorf("Expected response containing %q, got %q (%s)", healthCheck.Expect, received, err)
+		}
+	}
+
+	return fmt.Errorf("Expected response containing %q within the first %d bytes", healthCheck.Expect, tcpMaxResponseSize)
 }
@@ -1,14 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
 	"errors"
 	"fmt"
+	"io"
 	"os"
 	"path/filepath"
+	"sort"
 	"strings"
+	"sync"
+	"text/tabwriter"
+	"time"
 
 	"github.com/DBCDK/kingpin"
+	"github.com/DBCDK/morph/events"
 	"github.com/DBCDK/morph/filter"
 	"github.com/DBCDK/morph/healthchecks"
 	"github.com/DBCDK/morph/nix"
@@ -24,40 +31,58 @@ var assetRoot string
 var switchActions = []string{"dry-activate", "test", "switch", "boot"}
 
 var (
-	app                 = kingpin.New("morph", "NixOS host manager").Version(version)
-	dryRun              = app.Flag("dry-run", "Don't do anything, just eval and print changes").Default("False").Bool()
-	selectGlob          string
-	selectTags          string
-	selectEvery         int
-	selectSkip          int
-	selectLimit         int
-	orderingTags        string
-	deployment          string
-	timeout             int
-	askForSudoPasswd    bool
-	passCmd             string
-	nixBuildArg         []string
-	nixBuildTarget      string
-	nixBuildTargetFile  string
-	build               = buildCmd(app.Command("build", "Evaluate and build deployment configuration to the local Nix store"))
-	eval                = evalCmd(app.Command("eval", "Inspect value of an attribute without building"))
-	push                = pushCmd(app.Command("push", "Build and transfer items from the local Nix store to target machines"))
-	deploy              = deployCmd(app.Command("deploy", "Build, push and activate new configuration on machines according to switch-action"))
-	deploySwitchAction  string
-	deployUploadSecrets bool
-	deployReboot        bool
-	skipHealthChecks    bool
-	skipPreDeployChecks bool
-	showTrace           bool
-	healthCheck         = healthCheckCmd(app.Command("check-health", "Run health checks"))
-	uploadSecrets       = uploadSecretsCmd(app.Command("upload-secrets", "Upload secrets"))
-	listSecrets         = listSecretsCmd(app.Command("list-secrets", "List secrets"))
-	asJson              bool
-	attrkey             string
-	execute             = executeCmd(app.Command("exec", "Execute arbitrary commands on machines"))
-	executeCommand      []string
-	keepGCRoot          = app.Flag("keep-result", "Keep latest build in .gcroots to prevent it from being garbage collected").Default("False").Bool()
-	allowBuildShell     = app.Flag("allow-build-shell", "Allow using `network.buildShell` to build in a nix-shell which can execute arbitrary commands on the local system").Default("False").Bool()
+	app                   = kingpin.New("morph", "NixOS host manager").Version(version)
+	dryRun                = app.Flag("dry-run", "Don't do anything, just eval and print changes").Default("False").Bool()
+	selectGlobs           []string
+	selectRegexes         []string
+	excludeGlobs          []string
+	hostsFrom             string
+	selectWhere           []string
+	selectGroups          []string
+	selectChangedSince    string
+	selectShuffle         bool
+	selectSeed            int64
+	selectSeedSet         bool
+	selectShard           string
+	selectTags            string
+	selectEvery           int
+	selectSkip            int
+	selectLimit           int
+	orderingTags          string
+	deployment            string
+	timeout               int
+	askForSudoPasswd      bool
+	passCmd               string
+	nixBuildArg           []string
+	nixBuildTarget        string
+	nixBuildTargetFile    string
+	build                 = buildCmd(app.Command("build", "Evaluate and build deployment configuration to the local Nix store"))
+	eval                  = evalCmd(app.Command("eval", "Inspect value of an attribute without building"))
+	push                  = pushCmd(app.Command("push", "Build and transfer items from the local Nix store to target machines"))
+	deploy                = deployCmd(app.Command("deploy", "Build, push and activate new configuration on machines according to switch-action"))
+	deploySwitchAction    string
+	deployUploadSecrets   bool
+	deployReboot          bool
+	skipHealthChecks      bool
+	skipPreDeployChecks   bool
+	showTrace             bool
+	healthCheck           = healthCheckCmd(app.Command("check-health", "Run health checks"))
+	healthCheckReport     string
+	healthCheckReportFile string
+	healthCheckParallel   int
+	uploadSecrets         = uploadSecretsCmd(app.Command("upload-secrets", "Upload secrets"))
+	listSecrets           = listSecretsCmd(app.Command("list-secrets", "List secrets"))
+	listHosts             = listHostsCmd(app.Command("list-hosts", "List selected hosts"))
+	verifySecrets         = verifySecretsCmd(app.Command("verify-secrets", "Verify that uploaded secrets match their local sources"))
+	verifyExtraFiles      bool
+	secretActionResults   []secrets.ActionResult
+	asJson                bool
+	attrkey               string
+	execute               = executeCmd(app.Command("exec", "Execute arbitrary commands on machines"))
+	executeCommand        []string
+	keepGCRoot            = app.Flag("keep-result", "Keep latest build in .gcroots to prevent it from being garbage collected").Default("False").Bool()
+	outputFormat          = app.Flag("output-format", "Format of the progress output written to stderr: text, or json for a stream of newline-delimited JSON events").Default(events.FormatText).Enum(events.FormatText, events.FormatJSON)
+	allowBuildShell       = app.Flag("allow-build-shell", "Allow using `network.buildShell` to build in a nix-shell which can execute arbitrary commands on the local system").Default("False").Bool()
 )
 
 func deploymentArg(cmd *kingpin.CmdClause) {
@@ -94,12 +119,36 @@ func getSudoPasswdCommand(cmd *kingpin.CmdClause) {
 }
 
 func selectorFlags(cmd *kingpin.CmdClause) {
-	cmd.Flag("on", "Glob for selecting servers in the deployment").
-		Default("*").
-		StringVar(&selectGlob)
-	cmd.Flag("tagged", "Select hosts with these tags").
+	cmd.Flag("on", "Glob for selecting servers in the deployment (can be repeated)").
+		StringsVar(&selectGlobs)
+	cmd.Flag("on-regex", "Regular expression for selecting servers in the deployment (can be repeated)").
+		StringsVar(&selectRegexes)
+	cmd.Flag("exclude", "Glob for servers to leave out of the selection (can be repeated)").
+		StringsVar(&excludeGlobs)
+	cmd.Flag("hosts-from", "File listing names of servers to select, one per line (- for stdin)").
+		StringVar(&hostsFrom)
+	cmd.Flag("group", "Select hosts in a group declared in network.groups (can be repeated)").
+		StringsVar(&selectGroups)
+	cmd.Flag("tagged", "Select hosts by tags, e.g. \"prod,master\" or \"prod and not (db or rack-17)\"").
 		Default("").
 		StringVar(&selectTags)
+	cmd.Flag("where", "Select hosts where an option of the evaluated configuration has a value, e.g. 'services.nginx.enable == true' (can be repeated)").
+		StringsVar(&selectWhere)
+	cmd.Flag("changed-since", "Select hosts whose system configuration differs from a previous build result or git revision").
+		Default("").
+		StringVar(&selectChangedSince)
+	cmd.Flag("shuffle", "Shuffle hosts before ordering them by tags and applying --shard, --skip, --every and --limit").
+		Default("False").
+		BoolVar(&selectShuffle)
+	cmd.Flag("seed", "Seed to use with --shuffle, to get the same order every time (random by default)").
+		Action(func(*kingpin.ParseContext) error {
+			selectSeedSet = true
+			return nil
+		}).
+		Int64Var(&selectSeed)
+	cmd.Flag("shard", "Select the i'th of n shards of hosts (i/n), applied before --skip, --every and --limit").
+		Default("").
+		StringVar(&selectShard)
 	cmd.Flag("every", "Select every n hosts").
 		Default("1").
 		IntVar(&selectEvery)
@@ -226,6 +275,16 @@ func healthCheckCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	showTraceFlag(cmd)
 	deploymentArg(cmd)
 	timeoutFlag(cmd)
+	cmd.
+		Flag("parallel", "Number of hosts to run health checks on concurrently").
+		Default("10").
+		IntVar(&healthCheckParallel)
+	cmd.
+		Flag("report", "Write a machine-readable report of all health check attempts in this format").
+		EnumVar(&healthCheckReport, "json", "junit")
+	cmd.
+		Flag("report-file", "File to write the health check report to (defaults to stdout)").
+		StringVar(&healthCheckReportFile)
 	return cmd
 }
 
@@ -247,6 +306,28 @@ func listSecretsCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
 	return cmd
 }
 
+func listHostsCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	deploymentArg(cmd)
+	asJsonFlag(cmd)
+	return cmd
+}
+
+func verifySecretsCmd(cmd *kingpin.CmdClause) *kingpin.CmdClause {
+	selectorFlags(cmd)
+	showTraceFlag(cmd)
+	askForSudoPasswdFlag(cmd)
+	getSudoPasswdCommand(cmd)
+	deploymentArg(cmd)
+	asJsonFlag(cmd)
+	cmd.
+		Flag("extra", "Also report files in the secrets' destination directories that aren't declared as secrets").
+		Default("False").
+		BoolVar(&verifyExtraFiles)
+	return cmd
+}
+
 func setup() {
 	utils.ValidateEnvironment("nix")
 
@@ -260,10 +341,11 @@ func setup() {
 func main() {
 
 	clause := kingpin.MustParse(app.Parse(os.Args[1:]))
+	handleError(events.SetFormat(*outputFormat))
 
 	//TODO: Remove deprecation warning when removing --build-arg flag
 	if len(nixBuildArg) > 0 {
-		fmt.Fprintln(os.Stderr, "Deprecation: The --build-arg flag will be removed in a future release.")
+		events.Println("Deprecation: The --build-arg flag will be removed in a future release.")
 	}
 
 	defer utils.RunFinalizers()
@@ -298,17 +380,25 @@ func main() {
 		} else {
 			execListSecrets(hosts)
 		}
+	case listHosts.FullCommand():
+		err = execListHosts(hosts)
+	case verifySecrets.FullCommand():
+		err = execVerifySecrets(createSSHContext(), hosts)
 	case execute.FullCommand():
 		err = execExecute(hosts)
 	}
 
+	printSecretActionSummary()
 	handleError(err)
 }
 
 func handleError(err error) {
 	//Stupid handling of catch-all errors for now
 	if err != nil {
-		fmt.Fprintln(os.Stderr, err)
+		events.Emit(events.Event{
+			Type:    events.Error,
+			Message: fmt.Sprintln(err),
+		})
 		utils.Exit(1)
 	}
 }
@@ -318,12 +408,14 @@ func execExecute(hosts []nix.Host) error {
 
 	for _, host := range hosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Exec is disabled for build-only host: %s\n", host.Name)
+			events.HostPrintf(host.Name, "Exec is disabled for build-only host: %s\n", host.Name)
 			continue
 		}
-		fmt.Fprintln(os.Stderr, "** "+host.Name)
-		sshContext.CmdInteractive(&host, timeout, executeCommand...)
-		fmt.Fprintln(os.Stderr)
+		events.HostPrintf(host.Name, "** %s\n", host.Name)
+		if err := sshContext.CmdInteractive(&host, timeout, executeCommand...); err != nil {
+			events.HostPrintf(host.Name, "Exec of cmd: %s failed with err: '%s'\n", executeCommand, err.Error())
+		}
+		events.Println()
 	}
 
 	return nil
@@ -357,8 +449,20 @@ func execPush(hosts []nix.Host) (string, error) {
 		return "", err
 	}
 
-	fmt.Fprintln(os.Stderr)
-	return resultPath, pushPaths(createSSHContext(), hosts, resultPath)
+	events.Println()
+
+	sshContext := createSSHContext()
+	for _, host := range hosts {
+		err = pushPaths(sshContext, []nix.Host{host}, resultPath)
+		if err != nil {
+			return "", err
+		}
+		if !host.BuildOnly {
+			emitHostDone(host)
+		}
+	}
+
+	return resultPath, nil
 }
 
 func execDeploy(hosts []nix.Host) (string, error) {
@@ -387,13 +491,13 @@ func execDeploy(hosts []nix.Host) (string, error) {
 		return "", err
 	}
 
-	fmt.Fprintln(os.Stderr)
+	events.Println()
 
 	sshContext := createSSHContext()
 
 	for _, host := range hosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Deployment steps are disabled for build-only host: %s\n", host.Name)
+			events.HostPrintf(host.Name, "Deployment steps are disabled for build-only host: %s\n", host.Name)
 			continue
 		}
 
@@ -405,7 +509,7 @@ func execDeploy(hosts []nix.Host) (string, error) {
 				return "", err
 			}
 		}
-		fmt.Fprintln(os.Stderr)
+		events.Println()
 
 		if doUploadSecrets {
 			phase := "pre-activation"
@@ -414,21 +518,23 @@ func execDeploy(hosts []nix.Host) (string, error) {
 				return "", err
 			}
 
-			fmt.Fprintln(os.Stderr)
+			events.Println()
 		}
 
 		if !skipPreDeployChecks {
-			err := healthchecks.PerformPreDeployChecks(sshContext, &host, timeout)
+			_, err := healthchecks.PerformPreDeployChecks(utils.Context(), os.Stderr, sshContext, &host, timeout)
 			if err != nil {
-				fmt.Fprintln(os.Stderr)
-				fmt.Fprintln(os.Stderr, "Not deploying to additional hosts, since a host pre-deploy check failed.")
-				utils.Exit(1)
+				emitHostFailed(host, "pre-deploy-checks", err)
+				events.Println()
+				events.Println("Not deploying to additional hosts, since a host pre-deploy check failed.")
+				return "", err
 			}
 		}
 
 		if doActivate {
 			err = activateConfiguration(sshContext, singleHostInList, resultPath)
 			if err != nil {
+				emitHostFailed(host, "activate", err)
 				return "", err
 			}
 		}
@@ -436,7 +542,8 @@ func execDeploy(hosts []nix.Host) (string, error) {
 		if deployReboot {
 			err = host.Reboot(sshContext)
 			if err != nil {
-				fmt.Fprintln(os.Stderr, "Reboot failed")
+				events.HostPrintf(host.Name, "Reboot failed\n")
+				emitHostFailed(host, "reboot", err)
 				return "", err
 			}
 		}
@@ -448,24 +555,49 @@ func execDeploy(hosts []nix.Host) (string, error) {
 				return "", err
 			}
 
-			fmt.Fprintln(os.Stderr)
+			events.Println()
 		}
 
 		if !skipHealthChecks {
-			err := healthchecks.PerformHealthChecks(sshContext, &host, timeout)
+			_, err := healthchecks.PerformHealthChecks(utils.Context(), os.Stderr, sshContext, &host, timeout)
 			if err != nil {
-				fmt.Fprintln(os.Stderr)
-				fmt.Fprintln(os.Stderr, "Not deploying to additional hosts, since a host health check failed.")
-				utils.Exit(1)
+				emitHostFailed(host, "health-checks", err)
+				events.Println()
+				events.Println("Not deploying to additional hosts, since a host health check failed.")
+				return "", err
 			}
 		}
 
-		fmt.Fprintln(os.Stderr, "Done:", host.Name)
+		events.Emit(events.Event{
+			Type:    events.HostDone,
+			Host:    host.Name,
+			Message: fmt.Sprintln("Done:", host.Name),
+		})
 	}
 
 	return resultPath, nil
 }
 
+// Only emitted as an event, since the text output of a command already says when a host is done
+func emitHostDone(host nix.Host) {
+	events.Emit(events.Event{
+		Type: events.HostDone,
+		Host: host.Name,
+	})
+}
+
+// Only emitted as an event, since the reason has already been printed when using the text format
+func emitHostFailed(host nix.Host, step string, err error) {
+	events.Emit(events.Event{
+		Type: events.HostFailed,
+		Host: host.Name,
+		Data: map[string]interface{}{
+			"step":  step,
+			"error": err.Error(),
+		},
+	})
+}
+
 func createSSHContext() *ssh.SSHContext {
 	return &ssh.SSHContext{
 		AskForSudoPassword:     askForSudoPasswd,
@@ -477,46 +609,153 @@ func createSSHContext() *ssh.SSHContext {
 	}
 }
 
+// Run health checks on up to healthCheckParallel hosts at a time. The output of each host is buffered
+// and printed once its checks are done, unless hosts are checked one at a time.
 func execHealthCheck(hosts []nix.Host) error {
 	sshContext := createSSHContext()
 
-	var err error
+	parallel := healthCheckParallel
+	if parallel < 1 {
+		parallel = 1
+	}
+
+	checkable := 0
 	for _, host := range hosts {
+		if !host.BuildOnly {
+			checkable++
+		}
+	}
+	// output is only buffered when hosts are actually checked concurrently, so a single host shows progress live.
+	// Events are written as separate lines when using the JSON format, so they don't need buffering either.
+	buffered := parallel > 1 && checkable > 1 && !events.JSON()
+
+	var outputMutex sync.Mutex
+	results := make([]*healthchecks.CheckReport, len(hosts))
+	failed := make([]bool, len(hosts))
+	semaphore := make(chan struct{}, parallel)
+	wg := sync.WaitGroup{}
+
+	for index := range hosts {
+		host := &hosts[index]
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Healthchecks are disabled for build-only host: %s\n", host.Name)
+			events.HostPrintf(host.Name, "Healthchecks are disabled for build-only host: %s\n", host.Name)
 			continue
 		}
-		err = healthchecks.PerformHealthChecks(sshContext, &host, timeout)
+
+		semaphore <- struct{}{}
+		wg.Add(1)
+		go func(index int, host *nix.Host) {
+			defer wg.Done()
+			defer func() { <-semaphore }()
+
+			var out io.Writer = os.Stderr
+			var buffer bytes.Buffer
+			if buffered {
+				out = &buffer
+			}
+
+			report, err := healthchecks.PerformHealthChecks(utils.Context(), out, sshContext, host, timeout)
+			results[index] = &report
+			failed[index] = err != nil
+			if err != nil {
+				emitHostFailed(*host, "health-checks", err)
+			} else {
+				emitHostDone(*host)
+			}
+
+			if buffered {
+				outputMutex.Lock()
+				defer outputMutex.Unlock()
+				events.Progress(buffer.String() + "\n")
+			}
+		}(index, host)
 	}
 
+	wg.Wait()
+
+	checked := 0
+	var failedHosts []string
+	reports := make([]healthchecks.CheckReport, 0, len(hosts))
+	for index, report := range results {
+		if report == nil {
+			continue
+		}
+		checked++
+		reports = append(reports, *report)
+		if failed[index] {
+			failedHosts = append(failedHosts, hosts[index].Name)
+		}
+	}
+
+	// the report is written regardless of the outcome, since failing checks are what it's most useful for
+	if healthCheckReport != "" {
+		err := writeHealthCheckReport(reports)
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(failedHosts) > 0 {
+		return fmt.Errorf("Health checks failed on %d of %d host(s): %s", len(failedHosts), checked, strings.Join(failedHosts, ", "))
+	}
+
+	return nil
+}
+
+func writeHealthCheckReport(reports []healthchecks.CheckReport) (err error) {
+	out := os.Stdout
+	if healthCheckReportFile != "" {
+		out, err = os.Create(healthCheckReportFile)
+		if err != nil {
+			return err
+		}
+		defer out.Close()
+	}
+
+	switch healthCheckReport {
+	case "junit":
+		err = healthchecks.WriteJUnitReport(out, reports)
+	default:
+		err = healthchecks.WriteJSONReport(out, reports)
+	}
 	if err != nil {
-		err = errors.New("One or more errors occurred during host healthchecks")
+		return fmt.Errorf("Error writing health check report: %s", err)
 	}
 
-	return err
+	if healthCheckReportFile != "" {
+		events.Printf("Health check report written to %s\n", healthCheckReportFile)
+	}
+	return nil
 }
 
 func execUploadSecrets(sshContext *ssh.SSHContext, hosts []nix.Host, phase *string) error {
 	for _, host := range hosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Secret upload is disabled for build-only host: %s\n", host.Name)
+			events.HostPrintf(host.Name, "Secret upload is disabled for build-only host: %s\n", host.Name)
 			continue
 		}
 		singleHostInList := []nix.Host{host}
 
 		err := secretsUpload(sshContext, singleHostInList, phase)
 		if err != nil {
+			emitHostFailed(host, "upload-secrets", err)
 			return err
 		}
 
 		if !skipHealthChecks {
-			err = healthchecks.PerformHealthChecks(sshContext, &host, timeout)
+			_, err = healthchecks.PerformHealthChecks(utils.Context(), os.Stderr, sshContext, &host, timeout)
 			if err != nil {
-				fmt.Fprintln(os.Stderr)
-				fmt.Fprintln(os.Stderr, "Not uploading to additional hosts, since a host health check failed.")
+				emitHostFailed(host, "health-checks", err)
+				events.Println()
+				events.Println("Not uploading to additional hosts, since a host health check failed.")
 				return err
 			}
 		}
+
+		// when deploying (i.e. uploading the secrets of a single phase), the host isn't done until it's been activated
+		if phase == nil {
+			emitHostDone(host)
+		}
 	}
 
 	return nil
@@ -549,6 +788,11 @@ func execListSecretsAsJson(hosts []nix.Host) error {
 			for name, secret := range host.Secrets {
 				sourcePath := utils.GetAbsPathRelativeTo(secret.Source, deploymentDir)
 				secret.Source = sourcePath
+				templateValues := make(map[string]string)
+				for valueName, valuePath := range secret.TemplateValues {
+					templateValues[valueName] = utils.GetAbsPathRelativeTo(valuePath, deploymentDir)
+				}
+				secret.TemplateValues = templateValues
 				canonicalSecrets[name] = secret
 			}
 			secretsByHost[host.Name] = canonicalSecrets
@@ -564,8 +808,191 @@ func execListSecretsAsJson(hosts []nix.Host) error {
 	return nil
 }
 
+type hostListEntry struct {
+	Name            string   `json:"name"`
+	TargetHost      string   `json:"targetHost"`
+	TargetPort      int      `json:"targetPort,omitempty"`
+	TargetUser      string   `json:"targetUser,omitempty"`
+	Tags            []string `json:"tags"`
+	BuildOnly       bool     `json:"buildOnly"`
+	NixosRelease    string   `json:"nixosRelease"`
+	Secrets         int      `json:"secrets"`
+	HealthChecks    int      `json:"healthChecks"`
+	PreDeployChecks int      `json:"preDeployChecks"`
+}
+
+func execListHosts(hosts []nix.Host) error {
+	entries := make([]hostListEntry, 0, len(hosts))
+	for _, host := range hosts {
+		tags := host.GetTags()
+		if tags == nil {
+			tags = []string{}
+		}
+		entries = append(entries, hostListEntry{
+			Name:            host.Name,
+			TargetHost:      host.TargetHost,
+			TargetPort:      host.TargetPort,
+			TargetUser:      host.TargetUser,
+			Tags:            tags,
+			BuildOnly:       host.BuildOnly,
+			NixosRelease:    host.NixosRelease,
+			Secrets:         len(host.Secrets),
+			HealthChecks:    host.HealthChecks.Count(),
+			PreDeployChecks: host.PreDeployChecks.Count(),
+		})
+	}
+
+	if asJson {
+		jsonHosts, err := json.MarshalIndent(entries, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", jsonHosts)
+		return nil
+	}
+
+	w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tTARGET\tUSER\tTAGS\tBUILD-ONLY\tRELEASE\tSECRETS\tHEALTH CHECKS\tPRE-DEPLOY CHECKS")
+	for _, entry := range entries {
+		target := entry.TargetHost
+		if entry.TargetPort != 0 {
+			target = fmt.Sprintf("%s:%d", target, entry.TargetPort)
+		}
+		user := entry.TargetUser
+		if user == "" {
+			user = "-"
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%t\t%s\t%d\t%d\t%d\n", entry.Name, target, user, strings.Join(entry.Tags, ","),
+			entry.BuildOnly, entry.NixosRelease, entry.Secrets, entry.HealthChecks, entry.PreDeployChecks)
+	}
+	return w.Flush()
+}
+
+func execVerifySecrets(sshContext *ssh.SSHContext, hosts []nix.Host) error {
+	deploymentDir, err := filepath.Abs(filepath.Dir(deployment))
+	if err != nil {
+		return err
+	}
+
+	results := make([]secrets.VerifyResult, 0)
+	for _, host := range hosts {
+		if host.BuildOnly {
+			events.HostPrintf(host.Name, "Secret verification is disabled for build-only host: %s\n", host.Name)
+			continue
+		}
+
+		secretNames := make([]string, 0, len(host.Secrets))
+		for name := range host.Secrets {
+			secretNames = append(secretNames, name)
+		}
+		sort.Strings(secretNames)
+
+		events.HostPrintf(host.Name, "Verifying secrets on %s (%s)\n", host.Name, host.TargetHost)
+		for _, name := range secretNames {
+			secretResults, err := secrets.VerifySecret(sshContext, &host, name, host.Secrets[name], deploymentDir)
+			results = append(results, secretResults...)
+			if err != nil {
+				results = append(results, secrets.VerifyResult{
+					Host:        host.Name,
+					Secret:      name,
+					Destination: host.Secrets[name].Destination,
+					Status:      secrets.DriftError,
+					Differences: []string{err.Error()},
+				})
+			}
+		}
+
+		if verifyExtraFiles {
+			extraFiles, err := secrets.FindExtraFiles(sshContext, &host, host.Secrets)
+			results = append(results, extraFiles...)
+			if err != nil {
+				results = append(results, secrets.VerifyResult{
+					Host:        host.Name,
+					Status:      secrets.DriftError,
+					Differences: []string{fmt.Sprintf("Error while looking for extra files: %s", err)},
+				})
+			}
+		}
+	}
+
+	drift := 0
+	errorCount := 0
+	for _, result := range results {
+		if result.Status == secrets.DriftError {
+			errorCount++
+		} else if result.IsDrift() {
+			drift++
+		}
+	}
+
+	if asJson {
+		jsonResults, err := json.MarshalIndent(results, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintf(os.Stdout, "%s\n", jsonResults)
+	} else {
+		w := tabwriter.NewWriter(os.Stdout, 0, 8, 2, ' ', 0)
+		fmt.Fprintln(w, "HOST\tSECRET\tDESTINATION\tSTATUS\tDETAILS")
+		for _, result := range results {
+			fmt.Fprintf(w, "%s\t%s\t%s\t%s\t%s\n", result.Host, result.Secret, result.Destination, result.Status, strings.Join(result.Differences, "; "))
+		}
+		w.Flush()
+	}
+
+	if errorCount > 0 {
+		return fmt.Errorf("Secret verification failed for %d of %d result(s), and drift was detected in %d", errorCount, len(results), drift)
+	}
+	if drift > 0 {
+		return fmt.Errorf("Secret drift detected in %d of %d file(s)", drift, len(results))
+	}
+
+	return nil
+}
+
 func getHosts(deploymentPath string) (hosts []nix.Host, err error) {
 
+	var tagExpression filter.TagExpression
+	if selectTags != "" {
+		tagExpression, err = filter.ParseTagExpression(selectTags)
+		if err != nil {
+			return hosts, err
+		}
+	}
+
+	nameSelector, err := filter.NewNameSelector(selectGlobs, selectRegexes, excludeGlobs)
+	if err != nil {
+		return hosts, err
+	}
+
+	if hostsFrom != "" {
+		if hostsFrom == "-" && askForSudoPasswd {
+			return hosts, errors.New("--hosts-from - can't be combined with --passwd, since both read from stdin")
+		}
+		hostNames, err := readHostNames(hostsFrom)
+		if err != nil {
+			return hosts, err
+		}
+		nameSelector.AddNames(hostNames)
+	}
+
+	var shardIndex, shardCount int
+	if selectShard != "" {
+		shardIndex, shardCount, err = filter.ParseShard(selectShard)
+		if err != nil {
+			return hosts, err
+		}
+	}
+
+	var whereConditions []filter.WhereCondition
+	for _, condition := range selectWhere {
+		where, err := filter.ParseWhereCondition(condition)
+		if err != nil {
+			return hosts, err
+		}
+		whereConditions = append(whereConditions, where)
+	}
+
 	deploymentFile, err := os.Open(deploymentPath)
 	if err != nil {
 		return hosts, err
@@ -582,36 +1009,108 @@ func getHosts(deploymentPath string) (hosts []nix.Host, err error) {
 		return hosts, err
 	}
 
-	matchingHosts, err := filter.MatchHosts(deployment.Hosts, selectGlob)
+	// local paths in the deployment are relative to the deployment file
+	deploymentDir := filepath.Dir(deploymentAbsPath)
+	for index := range deployment.Hosts {
+		host := &deployment.Hosts[index]
+		host.HealthChecks = host.HealthChecks.ResolvePaths(deploymentDir)
+		host.PreDeployChecks = host.PreDeployChecks.ResolvePaths(deploymentDir)
+	}
+
+	matchingHosts, err := nameSelector.Select(deployment.Hosts)
 	if err != nil {
 		return hosts, err
 	}
 
-	var selectedTags []string
-	if selectTags != "" {
-		selectedTags = strings.Split(selectTags, ",")
+	matchingHosts, err = filter.FilterHostsGroups(matchingHosts, deployment.Meta.Groups, selectGroups)
+	if err != nil {
+		return hosts, err
 	}
 
-	matchingHosts2 := filter.FilterHostsTags(matchingHosts, selectedTags)
+	matchingHosts2 := filter.FilterHostsTagExpression(matchingHosts, tagExpression)
+
+	// conditions are evaluated one at a time, only for the hosts which are still selected
+	for _, where := range whereConditions {
+		if len(matchingHosts2) == 0 {
+			break
+		}
+		values, err := ctx.EvalNodesAttribute(deploymentAbsPath, matchingHosts2, where.Attribute)
+		if err != nil {
+			return hosts, err
+		}
+		matchingHosts2 = filter.FilterHostsWhere(matchingHosts2, where, values)
+	}
+
+	if selectChangedSince != "" {
+		matchingHosts2, err = ctx.GetChangedHosts(deploymentAbsPath, matchingHosts2, selectChangedSince)
+		if err != nil {
+			return hosts, err
+		}
+	}
 
 	ordering := deployment.Meta.Ordering
 	if orderingTags != "" {
 		ordering = nix.HostOrdering{Tags: strings.Split(orderingTags, ",")}
 	}
 
+	if selectShuffle {
+		if !selectSeedSet {
+			selectSeed = time.Now().UnixNano()
+		}
+		events.Printf("Shuffling hosts using seed %d\n", selectSeed)
+		matchingHosts2 = filter.ShuffleHosts(matchingHosts2, selectSeed)
+	}
+
 	sortedHosts := filter.SortHosts(matchingHosts2, ordering)
 
+	if shardCount > 0 {
+		sortedHosts = filter.ShardHosts(sortedHosts, shardIndex, shardCount)
+	}
+
 	filteredHosts := filter.FilterHosts(sortedHosts, selectSkip, selectEvery, selectLimit)
 
-	fmt.Fprintf(os.Stderr, "Selected %v/%v hosts (name filter:-%v, limits:-%v):\n", len(filteredHosts), len(deployment.Hosts), len(deployment.Hosts)-len(matchingHosts), len(matchingHosts)-len(filteredHosts))
+	events.Emit(events.Event{
+		Type:    events.HostsSelected,
+		Message: fmt.Sprintf("Selected %v/%v hosts (name filter:-%v, limits:-%v):\n", len(filteredHosts), len(deployment.Hosts), len(deployment.Hosts)-len(matchingHosts), len(matchingHosts)-len(filteredHosts)),
+		Data: map[string]interface{}{
+			"selected":   len(filteredHosts),
+			"total":      len(deployment.Hosts),
+			"nameFilter": len(deployment.Hosts) - len(matchingHosts),
+			"limits":     len(matchingHosts) - len(filteredHosts),
+		},
+	})
 	for index, host := range filteredHosts {
-		fmt.Fprintf(os.Stderr, "\t%3d: %s (secrets: %d, health checks: %d, tags: %s)\n", index, host.Name, len(host.Secrets), len(host.HealthChecks.Cmd)+len(host.HealthChecks.Http), strings.Join(host.GetTags(), ","))
+		events.Emit(events.Event{
+			Type:    events.HostSelected,
+			Host:    host.Name,
+			Message: fmt.Sprintf("\t%3d: %s (secrets: %d, health checks: %d, tags: %s)\n", index, host.Name, len(host.Secrets), host.HealthChecks.Count(), strings.Join(host.GetTags(), ",")),
+			Data: map[string]interface{}{
+				"index":        index,
+				"secrets":      len(host.Secrets),
+				"healthChecks": host.HealthChecks.Count(),
+				"tags":         host.GetTags(),
+			},
+		})
 	}
-	fmt.Fprintln(os.Stderr)
+	events.Println()
 
 	return filteredHosts, nil
 }
 
+func readHostNames(path string) ([]string, error) {
+	if path == "-" {
+		return filter.ReadHostNames(os.Stdin)
+	}
+
+	fh, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer fh.Close()
+
+	return filter.ReadHostNames(fh)
+}
+
 func getNixContext() *nix.NixContext {
 	evalCmd := os.Getenv("MORPH_NIX_EVAL_CMD")
 	buildCmd := os.Getenv("MORPH_NIX_BUILD_CMD")
@@ -662,14 +1161,31 @@ func buildHosts(hosts []nix.Host) (resultPath string, err error) {
 		nixBuildTargets = fmt.Sprintf("{ \"out\" = %s; }", nixBuildTarget)
 	}
 
+	hostNames := make([]string, 0, len(hosts))
+	for _, host := range hosts {
+		hostNames = append(hostNames, host.Name)
+	}
+	events.Emit(events.Event{
+		Type: events.BuildStarted,
+		Data: map[string]interface{}{"hosts": hostNames},
+	})
+
 	ctx := getNixContext()
 	resultPath, err = ctx.BuildMachines(deploymentPath, hosts, nixBuildArg, nixBuildTargets)
 
 	if err != nil {
+		events.Emit(events.Event{
+			Type: events.BuildFailed,
+			Data: map[string]interface{}{"error": err.Error()},
+		})
 		return
 	}
 
-	fmt.Fprintln(os.Stderr, "nix result path: ")
+	events.Emit(events.Event{
+		Type:    events.BuildFinished,
+		Message: "nix result path: \n",
+		Data:    map[string]interface{}{"resultPath": resultPath},
+	})
 	fmt.Println(resultPath)
 	return
 }
@@ -677,20 +1193,27 @@ func buildHosts(hosts []nix.Host) (resultPath string, err error) {
 func pushPaths(sshContext *ssh.SSHContext, filteredHosts []nix.Host, resultPath string) error {
 	for _, host := range filteredHosts {
 		if host.BuildOnly {
-			fmt.Fprintf(os.Stderr, "Push is disabled for build-only host: %s\n", host.Name)
+			events.HostPrintf(host.Name, "Push is disabled for build-only host: %s\n", host.Name)
 			continue
 		}
 
 		paths, err := nix.GetPathsToPush(host, resultPath)
 		if err != nil {
+			emitHostFailed(host, "push", err)
 			return err
 		}
-		fmt.Fprintf(os.Stderr, "Pushing paths to %v (%v@%v):\n", host.Name, host.TargetUser, host.TargetHost)
+		events.HostPrintf(host.Name, "Pushing paths to %v (%v@%v):\n", host.Name, host.TargetUser, host.TargetHost)
 		for _, path := range paths {
-			fmt.Fprintf(os.Stderr, "\t* %s\n", path)
+			events.Emit(events.Event{
+				Type:    events.PushPath,
+				Host:    host.Name,
+				Message: fmt.Sprintf("\t* %s\n", path),
+				Data:    map[string]interface{}{"path": path},
+			})
 		}
 		err = nix.Push(sshContext, host, paths...)
 		if err != nil {
+			emitHostFailed(host, "push", err)
 			return err
 		}
 	}
@@ -703,8 +1226,8 @@ func secretsUpload(ctx ssh.Context, filteredHosts []nix.Host, phase *string) err
 	// relative paths are resolved relative to the deployment file (!)
 	deploymentDir := filepath.Dir(deployment)
 	for _, host := range filteredHosts {
-		fmt.Fprintf(os.Stderr, "Uploading secrets to %s (%s):\n", host.Name, host.TargetHost)
-		postUploadActions := make(map[string][]string, 0)
+		events.HostPrintf(host.Name, "Uploading secrets to %s (%s):\n", host.Name, host.TargetHost)
+		uploadedSecrets := make([]string, 0)
 		for secretName, secret := range host.Secrets {
 			// if phase is nil, upload the secrets no matter what phase it wants
 			// if phase is non-nil, upload the secrets that match the specified phase
@@ -712,46 +1235,118 @@ func secretsUpload(ctx ssh.Context, filteredHosts []nix.Host, phase *string) err
 				continue
 			}
 
-			secretSize, err := secrets.GetSecretSize(secret, deploymentDir)
+			secretSize, err := secrets.GetSecretSize(&host, secret, deploymentDir)
 			if err != nil {
 				return err
 			}
 
 			secretErr := secrets.UploadSecret(ctx, &host, secret, deploymentDir)
-			fmt.Fprintf(os.Stderr, "\t* %s (%d bytes).. ", secretName, secretSize)
+			event := events.Event{
+				Type: events.SecretUploaded,
+				Host: host.Name,
+				Data: map[string]interface{}{
+					"secret":      secretName,
+					"destination": secret.Destination,
+					"size":        secretSize,
+					"status":      "ok",
+				},
+			}
+			message := fmt.Sprintf("\t* %s (%d bytes).. ", secretName, secretSize)
 			if secretErr != nil {
+				event.Data["error"] = secretErr.Error()
 				if secretErr.Fatal {
-					fmt.Fprintln(os.Stderr, "Failed")
+					event.Type = events.SecretFailed
+					event.Data["status"] = "failed"
+					event.Message = message + "Failed\n"
+					events.Emit(event)
 					return secretErr
 				} else {
-					fmt.Fprintln(os.Stderr, "Partial")
-					fmt.Fprint(os.Stderr, secretErr.Error())
+					event.Data["status"] = "partial"
+					event.Message = message + "Partial\n" + secretErr.Error()
 				}
 			} else {
-				fmt.Fprintln(os.Stderr, "OK")
-			}
-			if len(secret.Action) > 0 {
-				// ensure each action is only run once
-				postUploadActions[strings.Join(secret.Action, " ")] = secret.Action
+				event.Message = message + "OK\n"
 			}
+			events.Emit(event)
+			uploadedSecrets = append(uploadedSecrets, secretName)
 		}
+
 		// Execute post-upload secret actions one-by-one after all secrets have been uploaded
-		for _, action := range postUploadActions {
-			fmt.Fprintf(os.Stderr, "\t- executing post-upload command: "+strings.Join(action, " ")+"\n")
-			// Errors from secret actions will be printed on screen, but we won't stop the flow if they fail
-			ctx.CmdInteractive(&host, timeout, action...)
+		for _, action := range secrets.CollectActions(host.Secrets, uploadedSecrets) {
+			events.HostPrintf(host.Name, "\t- executing post-upload command: %s\n", action)
+
+			actionTimeout := action.Timeout
+			if actionTimeout <= 0 {
+				actionTimeout = timeout
+			}
+
+			start := time.Now()
+			err := ctx.CmdInteractive(&host, actionTimeout, action.Command...)
+			result := secrets.ActionResult{
+				Host:     host.Name,
+				Command:  action.Command,
+				Secrets:  action.Secrets,
+				Duration: time.Since(start),
+				Err:      err,
+			}
+			secretActionResults = append(secretActionResults, result)
+
+			event := events.Event{
+				Type: events.SecretAction,
+				Host: host.Name,
+				Data: map[string]interface{}{
+					"command":  action.Command,
+					"secrets":  action.Secrets,
+					"duration": result.Duration.Seconds(),
+					"status":   "ok",
+				},
+			}
+			if err != nil {
+				event.Data["status"] = "failed"
+				event.Data["error"] = err.Error()
+				if action.OnFailure == secrets.ActionFailureWarn {
+					event.Message = fmt.Sprintf("\t  Warning: post-upload command `%s` failed: %s\n", action, err)
+				}
+			}
+			events.Emit(event)
+
+			if err != nil && action.OnFailure == secrets.ActionFailureAbort {
+				return fmt.Errorf("Post-upload command `%s` failed on %s: %s", action, host.Name, err)
+			}
 		}
 	}
 
 	return nil
 }
 
+func printSecretActionSummary() {
+	if len(secretActionResults) == 0 {
+		return
+	}
+
+	// each command has already been reported as an event
+	if events.JSON() {
+		return
+	}
+
+	events.Println()
+	events.Println("Post-upload commands:")
+	for _, result := range secretActionResults {
+		status := "OK"
+		if result.Err != nil {
+			status = fmt.Sprintf("Failed (%s)", result.Err)
+		}
+		events.Printf("\t* %s: `%s` (secrets: %s, %s): %s\n",
+			result.Host, strings.Join(result.Command, " "), strings.Join(result.Secrets, ", "), result.Duration.Round(time.Millisecond), status)
+	}
+}
+
 func activateConfiguration(ctx ssh.Context, filteredHosts []nix.Host, resultPath string) error {
-	fmt.Fprintln(os.Stderr, "Executing '"+deploySwitchAction+"' on matched hosts:")
-	fmt.Fprintln(os.Stderr)
+	events.Println("Executing '" + deploySwitchAction + "' on matched hosts:")
+	events.Println()
 	for _, host := range filteredHosts {
 
-		fmt.Fprintln(os.Stderr, "** "+host.Name)
+		events.HostPrintf(host.Name, "** %s\n", host.Name)
 
 		configuration, err := nix.GetNixSystemPath(host, resultPath)
 		if err != nil {
@@ -759,11 +1354,25 @@ func activateConfiguration(ctx ssh.Context, filteredHosts []nix.Host, resultPath
 		}
 
 		err = ctx.ActivateConfiguration(&host, configuration, deploySwitchAction)
+		event := events.Event{
+			Type: events.Activation,
+			Host: host.Name,
+			Data: map[string]interface{}{
+				"action":        deploySwitchAction,
+				"configuration": configuration,
+				"status":        "ok",
+			},
+		}
+		if err != nil {
+			event.Data["status"] = "failed"
+			event.Data["error"] = err.Error()
+		}
+		events.Emit(event)
 		if err != nil {
 			return err
 		}
 
-		fmt.Fprintln(os.Stderr)
+		events.Println()
 	}
 
 	return nil
@@ -0,0 +1,177 @@
+package nix
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+
+	"github.com/DBCDK/morph/events"
+	"github.com/DBCDK/morph/utils"
+)
+
+// Evaluate the derivation of each host's system configuration, without building it
+func (ctx *NixContext) GetSystemDerivations(deploymentPath string, hosts []Host) (derivations map[string]string, err error) {
+	values, err := ctx.EvalNodesAttribute(deploymentPath, hosts, "system.build.toplevel.drvPath")
+	if err != nil {
+		return derivations, err
+	}
+
+	derivations = make(map[string]string)
+	for name, value := range values {
+		if drvPath, ok := value.(string); ok {
+			derivations[name] = drvPath
+		}
+	}
+
+	return derivations, nil
+}
+
+// Select the hosts whose system derivation differs from the one in a previous build or git revision.
+// since is either the path of a previous build result (e.g. a gcroot kept with --keep-result), or a git
+// revision of the repository containing the deployment. Hosts which aren't part of the previous build or
+// revision are considered changed.
+func (ctx *NixContext) GetChangedHosts(deploymentPath string, hosts []Host, since string) (changedHosts []Host, err error) {
+	if len(hosts) == 0 {
+		return hosts, nil
+	}
+
+	derivations, err := ctx.GetSystemDerivations(deploymentPath, hosts)
+	if err != nil {
+		return changedHosts, err
+	}
+
+	var previousDerivations map[string]string
+	if _, err := os.Stat(since); err == nil {
+		previousDerivations, err = getResultDerivations(hosts, since)
+		if err != nil {
+			return changedHosts, err
+		}
+	} else {
+		previousDeploymentPath, err := checkoutRevision(deploymentPath, since)
+		if err != nil {
+			return changedHosts, err
+		}
+
+		events.Printf("Evaluating deployment at revision %s\n", since)
+		previousDerivations, err = ctx.GetSystemDerivations(previousDeploymentPath, hosts)
+		if err != nil {
+			return changedHosts, err
+		}
+	}
+
+	for _, host := range hosts {
+		previous, ok := previousDerivations[host.Name]
+		if !ok || previous != derivations[host.Name] {
+			changedHosts = append(changedHosts, host)
+		}
+	}
+
+	return changedHosts, nil
+}
+
+func getResultDerivations(hosts []Host, resultPath string) (derivations map[string]string, err error) {
+	derivations = make(map[string]string)
+	for _, host := range hosts {
+		drvPath, err := GetNixSystemDerivation(host, resultPath)
+		if os.IsNotExist(err) {
+			// the host wasn't part of the build
+			continue
+		}
+		if err != nil {
+			return derivations, err
+		}
+		derivations[host.Name] = drvPath
+	}
+
+	if len(derivations) == 0 {
+		return derivations, fmt.Errorf("No system derivations found in %s. Builds made with older versions of morph don't include them, and builds with custom --target's never do.", resultPath)
+	}
+
+	return derivations, nil
+}
+
+// Extract the git revision of the repository containing the deployment into a temporary directory,
+// and return the path of the deployment in it. Only files tracked by git are included.
+func checkoutRevision(deploymentPath string, revision string) (revisionDeploymentPath string, err error) {
+	utils.ValidateEnvironment("git", "tar")
+
+	deploymentPath, err = filepath.EvalSymlinks(deploymentPath)
+	if err != nil {
+		return "", err
+	}
+	deploymentDir := filepath.Dir(deploymentPath)
+
+	topLevel, err := gitOutput(deploymentDir, "rev-parse", "--show-toplevel")
+	if err != nil {
+		return "", fmt.Errorf("%s is neither a build result nor a git revision: %s", revision, err)
+	}
+	commit, err := gitOutput(deploymentDir, "rev-parse", "--verify", "--quiet", revision+"^{commit}")
+	if err != nil {
+		return "", fmt.Errorf("%s is neither a build result nor a git revision", revision)
+	}
+
+	relPath, err := filepath.Rel(topLevel, deploymentPath)
+	if err != nil {
+		return "", err
+	}
+
+	tmpdir, err := ioutil.TempDir("", "morph-")
+	if err != nil {
+		return "", err
+	}
+	utils.AddFinalizer(func() {
+		os.RemoveAll(tmpdir)
+	})
+
+	archiveCmd := exec.Command("git", "-C", topLevel, "archive", "--format=tar", commit)
+	extractCmd := exec.Command("tar", "--extract", "--directory", tmpdir)
+
+	extractCmd.Stdin, err = archiveCmd.StdoutPipe()
+	if err != nil {
+		return "", err
+	}
+	var archiveStderr, extractStderr bytes.Buffer
+	archiveCmd.Stderr = &archiveStderr
+	extractCmd.Stderr = &extractStderr
+
+	if err = extractCmd.Start(); err != nil {
+		return "", err
+	}
+	if err = archiveCmd.Run(); err != nil {
+		_ = extractCmd.Wait()
+		return "", fmt.Errorf("Error while running `git archive %s`: %s", revision, strings.TrimSpace(archiveStderr.String()))
+	}
+	if err = extractCmd.Wait(); err != nil {
+		return "", fmt.Errorf("Error while extracting revision %s: %s", revision, strings.TrimSpace(extractStderr.String()))
+	}
+
+	revisionDeploymentPath = filepath.Join(tmpdir, relPath)
+	if _, err = os.Stat(revisionDeploymentPath); err != nil {
+		return "", fmt.Errorf("%s doesn't exist at revision %s", relPath, revision)
+	}
+
+	return revisionDeploymentPath, nil
+}
+
+func gitOutput(dir string, args ...string) (string, error) {
+	cmd := exec.Command("git", append([]string{"-C", dir}, args...)...)
+
+	var stdout, stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	if err := cmd.Run(); err != nil {
+		message := strings.TrimSpace(stderr.String())
+		if message == "" {
+			message = err.Error()
+		}
+		return "", errors.New(message)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
@@ -14,6 +14,7 @@ import (
 	"syscall"
 	"time"
 
+	"github.com/DBCDK/morph/events"
 	"github.com/DBCDK/morph/healthchecks"
 	"github.com/DBCDK/morph/secrets"
 	"github.com/DBCDK/morph/ssh"
@@ -39,9 +40,17 @@ type HostOrdering struct {
 	Tags []string
 }
 
+// A named selection of hosts, declared with `network.groups.<name>`
+type HostGroup struct {
+	Tags    []string
+	Hosts   []string
+	Exclude []string
+}
+
 type DeploymentMetadata struct {
 	Description string
 	Ordering    HostOrdering
+	Groups      map[string]HostGroup
 }
 
 type Deployment struct {
@@ -174,45 +183,50 @@ func (host *Host) Reboot(sshContext *ssh.SSHContext) error {
 	// If the host doesn't support getting boot ID's for some reason, warn about it, and skip the comparison
 	skipBootIDComparison := err != nil
 	if skipBootIDComparison {
-		fmt.Fprintf(os.Stderr, "Error getting boot ID (this is used to determine when the reboot is complete): %v\n", err)
-		fmt.Fprintf(os.Stderr, "This makes it impossible to detect when the host has rebooted, so health checks might pass before the host has rebooted.\n")
+		events.HostPrintf(host.Name, "Error getting boot ID (this is used to determine when the reboot is complete): %v\n", err)
+		events.HostPrintf(host.Name, "This makes it impossible to detect when the host has rebooted, so health checks might pass before the host has rebooted.\n")
 	}
 
 	if cmd, err := sshContext.Cmd(host, "sudo", "reboot"); cmd != nil {
-		fmt.Fprint(os.Stderr, "Asking host to reboot ... ")
+		events.HostPrintf(host.Name, "Asking host to reboot ... ")
 		if err = cmd.Run(); err != nil {
 			// Here we assume that exit code 255 means: "SSH connection got disconnected",
 			// which is OK for a reboot - sshd may close active connections before we disconnect after all
 			if exitErr, ok := err.(*exec.ExitError); ok {
 				if status, ok := exitErr.Sys().(syscall.WaitStatus); ok && status.ExitStatus() == 255 {
-					fmt.Fprintln(os.Stderr, "Remote host disconnected.")
+					events.HostPrintf(host.Name, "Remote host disconnected.\n")
 					err = nil
 				}
 			}
 		}
 
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "Failed")
+			events.Emit(events.Event{
+				Type:    events.Reboot,
+				Host:    host.Name,
+				Message: "Failed\n",
+				Data:    map[string]interface{}{"status": "failed", "error": err.Error()},
+			})
 			return err
 		}
 	}
 
-	fmt.Fprintln(os.Stderr, "OK")
+	events.Progress("OK\n")
 
 	if !skipBootIDComparison {
-		fmt.Fprint(os.Stderr, "Waiting for host to come online ")
+		events.HostPrintf(host.Name, "Waiting for host to come online ")
 
 		// Wait for the host to get a new boot ID. These ID's should be unique for each boot,
 		// meaning a reboot will have been completed when the boot ID has changed.
 		for {
-			fmt.Fprint(os.Stderr, ".")
+			events.Progress(".")
 
 			// Ignore errors; there'll be plenty of them since we'll be attempting to connect to an offline host,
 			// and we know from previously that the host should support boot ID's
 			newBootID, _ = sshContext.GetBootID(host)
 
 			if newBootID != "" && oldBootID != newBootID {
-				fmt.Fprintln(os.Stderr, " OK")
+				events.Progress(" OK\n")
 				break
 			}
 
@@ -220,6 +234,12 @@ func (host *Host) Reboot(sshContext *ssh.SSHContext) error {
 		}
 	}
 
+	events.Emit(events.Event{
+		Type: events.Reboot,
+		Host: host.Name,
+		Data: map[string]interface{}{"status": "ok"},
+	})
+
 	return nil
 }
 
@@ -242,7 +262,9 @@ func (ctx *NixContext) GetBuildShell(deploymentPath string) (buildShell *string,
 
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
-	cmd.Stderr = os.Stderr
+	stderr, flush := events.Output("", "nix-instantiate")
+	defer flush()
+	cmd.Stderr = stderr
 
 	utils.AddFinalizer(func() {
 		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
@@ -291,8 +313,10 @@ func (ctx *NixContext) EvalHosts(deploymentPath string, attr string) (string, er
 		}
 	})
 
+	stderr, flush := events.Output("", "nix-instantiate")
+	defer flush()
 	cmd.Stdout = os.Stdout
-	cmd.Stderr = os.Stderr
+	cmd.Stderr = stderr
 	cmd.Env = os.Environ()
 	cmd.Env = append(cmd.Env, fmt.Sprintf("MORPH_ARGS=%s", jsonArgs))
 	err = cmd.Run()
@@ -318,7 +342,9 @@ func (ctx *NixContext) GetMachines(deploymentPath string) (deployment Deployment
 
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
-	cmd.Stderr = os.Stderr
+	stderr, flush := events.Output("", "nix-instantiate")
+	defer flush()
+	cmd.Stderr = stderr
 
 	utils.AddFinalizer(func() {
 		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
@@ -343,6 +369,84 @@ func (ctx *NixContext) GetMachines(deploymentPath string) (deployment Deployment
 	return deployment, nil
 }
 
+type NodeAttrsArgs struct {
+	Names     []string
+	Attribute string
+}
+
+// Evaluate an option (e.g. "services.postgresql.enable") of each of the given hosts' configuration.
+// Hosts where the option isn't defined have a nil value.
+func (ctx *NixContext) EvalNodesAttribute(deploymentPath string, hosts []Host, attribute string) (values map[string]interface{}, err error) {
+	tmpdir, err := ioutil.TempDir("", "morph-")
+	if err != nil {
+		return values, err
+	}
+	defer os.RemoveAll(tmpdir)
+
+	hostNames := []string{}
+	for _, host := range hosts {
+		hostNames = append(hostNames, host.Name)
+	}
+
+	argsFile := filepath.Join(tmpdir, "morph-args.json")
+	fileArgs, err := json.Marshal(NodeAttrsArgs{
+		Names:     hostNames,
+		Attribute: attribute,
+	})
+	if err != nil {
+		return values, err
+	}
+
+	err = ioutil.WriteFile(argsFile, fileArgs, 0644)
+	if err != nil {
+		return values, err
+	}
+
+	nixEvalInvocationArgs := NixEvalInvocationArgs{
+		AsJSON:         true,
+		ArgsFile:       argsFile,
+		Attr:           "nodeAttrs",
+		DeploymentPath: deploymentPath,
+		NixContext:     *ctx,
+		Strict:         true,
+	}
+
+	jsonArgs, err := json.Marshal(nixEvalInvocationArgs)
+	if err != nil {
+		return values, err
+	}
+
+	cmd := exec.Command(ctx.EvalCmd, nixEvalInvocationArgs.ToNixInstantiateArgs()...)
+
+	var stdout bytes.Buffer
+	cmd.Stdout = &stdout
+	stderr, flush := events.Output("", "nix-instantiate")
+	defer flush()
+	cmd.Stderr = stderr
+
+	utils.AddFinalizer(func() {
+		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
+			_ = cmd.Process.Signal(syscall.SIGTERM)
+		}
+	})
+	cmd.Env = os.Environ()
+	cmd.Env = append(cmd.Env, fmt.Sprintf("MORPH_ARGS=%s", jsonArgs))
+	err = cmd.Run()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error while evaluating `%s` with `%s ..`: %s", attribute, ctx.EvalCmd, err.Error(),
+		)
+		return values, errors.New(errorMessage)
+	}
+
+	err = json.Unmarshal(stdout.Bytes(), &values)
+	if err != nil {
+		return values, err
+	}
+
+	return values, nil
+}
+
 func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArgs []string, nixBuildTargets string) (resultPath string, err error) {
 	tmpdir, err := ioutil.TempDir("", "morph-")
 	if err != nil {
@@ -361,7 +465,7 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 	if ctx.KeepGCRoot {
 		if err = os.MkdirAll(path.Dir(resultLinkPath), 0755); err != nil {
 			ctx.KeepGCRoot = false
-			fmt.Fprintf(os.Stderr, "Unable to create GC root, skipping: %s", err)
+			events.Printf("Unable to create GC root, skipping: %s", err)
 		}
 	}
 	if !ctx.KeepGCRoot {
@@ -411,9 +515,11 @@ func (ctx *NixContext) BuildMachines(deploymentPath string, hosts []Host, nixArg
 
 	}
 
-	// show process output on attached stdout/stderr
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
+	// show process output on attached stderr
+	output, flush := events.Output("", "nix-build")
+	defer flush()
+	cmd.Stdout = output
+	cmd.Stderr = output
 	utils.AddFinalizer(func() {
 		if (cmd.ProcessState == nil || !cmd.ProcessState.Exited()) && cmd.Process != nil {
 			_ = cmd.Process.Signal(syscall.SIGTERM)
@@ -517,9 +623,11 @@ func Push(ctx *ssh.SSHContext, host Host, paths ...string) (err error) {
 		)
 		cmd.Env = env
 
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
+		output, flush := events.Output(host.Name, "nix-copy-closure")
+		cmd.Stdout = output
+		cmd.Stderr = output
 		err = cmd.Run()
+		flush()
 
 		if err != nil {
 			return err
@@ -0,0 +1,96 @@
+package secrets
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const (
+	ActionFailureIgnore = "ignore"
+	ActionFailureWarn   = "warn"
+	ActionFailureAbort  = "abort"
+)
+
+// A post-upload action, shared by all the secrets that declare the same command
+type Action struct {
+	Command   []string
+	Order     int
+	OnFailure string
+	Timeout   int
+	Secrets   []string
+}
+
+type ActionResult struct {
+	Host     string
+	Command  []string
+	Secrets  []string
+	Duration time.Duration
+	Err      error
+}
+
+func (a Action) String() string {
+	return strings.Join(a.Command, " ")
+}
+
+var actionFailureSeverity = map[string]int{
+	ActionFailureIgnore: 0,
+	ActionFailureWarn:   1,
+	ActionFailureAbort:  2,
+}
+
+// Collect the actions of the named secrets, so each command is only run once.
+// When several secrets declare the same command, the lowest order, the strictest failure policy and the
+// longest timeout wins. Actions are sorted by order, and then by command to make the ordering deterministic.
+func CollectActions(secrets map[string]Secret, names []string) (actions []Action) {
+	byCommand := make(map[string]*Action)
+	for _, name := range names {
+		secret := secrets[name]
+		if len(secret.Action) == 0 {
+			continue
+		}
+
+		onFailure := secret.OnActionFailure
+		if onFailure == "" {
+			onFailure = ActionFailureWarn
+		}
+
+		key := strings.Join(secret.Action, " ")
+		action, ok := byCommand[key]
+		if !ok {
+			byCommand[key] = &Action{
+				Command:   secret.Action,
+				Order:     secret.ActionOrder,
+				OnFailure: onFailure,
+				Timeout:   secret.ActionTimeout,
+				Secrets:   []string{name},
+			}
+			continue
+		}
+
+		action.Secrets = append(action.Secrets, name)
+		if secret.ActionOrder < action.Order {
+			action.Order = secret.ActionOrder
+		}
+		if actionFailureSeverity[onFailure] > actionFailureSeverity[action.OnFailure] {
+			action.OnFailure = onFailure
+		}
+		if secret.ActionTimeout > action.Timeout {
+			action.Timeout = secret.ActionTimeout
+		}
+	}
+
+	for _, action := range byCommand {
+		sort.Strings(action.Secrets)
+		actions = append(actions, *action)
+	}
+
+	sort.Slice(actions, func(i, j int) bool {
+		if actions[i].Order != actions[j].Order {
+			return actions[i].Order < actions[j].Order
+		}
+		return actions[i].String() < actions[j].String()
+	})
+
+	return actions
+}
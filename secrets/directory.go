@@ -0,0 +1,174 @@
+package secrets
+
+import (
+	"archive/tar"
+	"errors"
+	"io"
+	"os"
+	"path/filepath"
+
+	"github.com/DBCDK/morph/ssh"
+	"github.com/DBCDK/morph/utils"
+)
+
+func IsDirectory(secret Secret, deploymentWD string) (bool, error) {
+	fStats, err := os.Stat(utils.GetAbsPathRelativeTo(secret.Source, deploymentWD))
+	if err != nil {
+		return false, err
+	}
+
+	return fStats.IsDir(), nil
+}
+
+// List all regular files below a local directory, relative to the directory
+func listFiles(root string) (files []string, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.Mode().IsRegular() {
+			return nil
+		}
+		relPath, err := filepath.Rel(root, path)
+		if err != nil {
+			return err
+		}
+		files = append(files, relPath)
+		return nil
+	})
+
+	return files, err
+}
+
+func directorySize(root string) (size int64, err error) {
+	err = filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.Mode().IsRegular() {
+			size += info.Size()
+		}
+		return nil
+	})
+
+	return size, err
+}
+
+// Write a local directory as a tar archive. Only directories and regular files are included.
+func writeArchive(w io.Writer, root string) error {
+	archive := tar.NewWriter(w)
+
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if !info.IsDir() && !info.Mode().IsRegular() {
+			return nil
+		}
+
+		relPath, err := filepath.Rel(root, path)
+		if err != nil || relPath == "." {
+			return err
+		}
+
+		header, err := tar.FileInfoHeader(info, "")
+		if err != nil {
+			return err
+		}
+		header.Name = filepath.ToSlash(relPath)
+		if err = archive.WriteHeader(header); err != nil {
+			return err
+		}
+
+		if info.IsDir() {
+			return nil
+		}
+
+		fh, err := os.Open(path)
+		if err != nil {
+			return err
+		}
+		defer fh.Close()
+
+		_, err = io.Copy(archive, fh)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+
+	return archive.Close()
+}
+
+// Upload a directory by extracting it into a root-owned temporary directory in the staging directory,
+// fixing up ownership and permissions there, and finally moving it into place.
+func uploadDirectory(ctx ssh.Context, host Host, secret Secret, deploymentWD string) *SecretError {
+	if secret.Template {
+		return wrap(errors.New("Templates are not supported for directory secrets"))
+	}
+
+	sourcePath := utils.GetAbsPathRelativeTo(secret.Source, deploymentWD)
+
+	stagingPath, err := ctx.MakeTempDir(host, GetStagingDirectory(secret))
+	if err != nil {
+		return wrap(err)
+	}
+
+	err = stageDirectory(ctx, host, secret, sourcePath, stagingPath)
+	if err != nil {
+		ctx.RemovePath(host, stagingPath, true)
+		return wrap(err)
+	}
+
+	err = ctx.ReplaceDirectory(host, stagingPath, secret.Destination)
+	if err != nil {
+		ctx.RemovePath(host, stagingPath, true)
+		return wrap(err)
+	}
+
+	return nil
+}
+
+func stageDirectory(ctx ssh.Context, host Host, secret Secret, sourcePath string, stagingPath string) error {
+	reader, writer := io.Pipe()
+	go func() {
+		writer.CloseWithError(writeArchive(writer, sourcePath))
+	}()
+
+	err := ctx.ExtractArchive(host, reader, stagingPath)
+	reader.Close()
+	if err != nil {
+		return err
+	}
+
+	err = ctx.SetOwnerRecursive(host, stagingPath, secret.Owner.User, secret.Owner.Group)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.SetPermissionsRecursive(host, stagingPath, "d", secret.DirectoryPermissions)
+	if err != nil {
+		return err
+	}
+
+	err = ctx.SetPermissionsRecursive(host, stagingPath, "f", secret.Permissions)
+	if err != nil {
+		return err
+	}
+
+	for relPath, file := range secret.Files {
+		path := filepath.Join(stagingPath, relPath)
+		if file.Owner != nil {
+			if err = ctx.SetOwner(host, path, file.Owner.User, file.Owner.Group); err != nil {
+				return err
+			}
+		}
+		if file.Permissions != "" {
+			if err = ctx.SetPermissions(host, path, file.Permissions); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
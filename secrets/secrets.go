@@ -1,6 +1,7 @@
 package secrets
 
 import (
+	"bytes"
 	"github.com/DBCDK/morph/ssh"
 	"github.com/DBCDK/morph/utils"
 	"os"
@@ -30,21 +31,41 @@ func (e SecretError) Error() string {
 	return e.Err.Error()
 }
 
-func GetSecretSize(secret Secret, deploymentWD string) (size int64, err error) {
+func GetSecretSize(host Host, secret Secret, deploymentWD string) (size int64, err error) {
+	if secret.Template {
+		content, err := ReadSecret(host, secret, deploymentWD)
+		return int64(len(content)), err
+	}
+
 	fh, err := os.Open(utils.GetAbsPathRelativeTo(secret.Source, deploymentWD))
 	if err != nil {
 		return size, err
 	}
+	defer fh.Close()
 
 	fStats, err := fh.Stat()
 	if err != nil {
 		return size, err
 	}
 
+	if fStats.IsDir() {
+		return directorySize(fh.Name())
+	}
+
 	return fStats.Size(), nil
 }
 
-func UploadSecret(ctx ssh.Context, host ssh.Host, secret Secret, deploymentWD string) *SecretError {
+// Returns the directory a secret is staged in before being moved to its destination.
+// Unless configured otherwise, this is the destination directory itself, which ensures the final
+// move is an atomic rename on the same filesystem.
+func GetStagingDirectory(secret Secret) string {
+	if secret.StagingDirectory != "" {
+		return secret.StagingDirectory
+	}
+	return filepath.Dir(secret.Destination)
+}
+
+func UploadSecret(ctx ssh.Context, host Host, secret Secret, deploymentWD string) *SecretError {
 	var partialErr *SecretError
 
 	err := ctx.WaitForMountPoints(host, secret.Destination)
@@ -52,36 +73,59 @@ func UploadSecret(ctx ssh.Context, host ssh.Host, secret Secret, deploymentWD st
 		return wrap(err)
 	}
 
-	tempPath, err := ctx.MakeTempFile(host)
-	if err != nil {
-		return wrap(err)
-	}
-
 	if secret.MkDirs {
 		if err := ctx.MakeDirs(host, filepath.Dir(secret.Destination), true, 0755); err != nil {
 			return wrap(err)
 		}
+		if secret.StagingDirectory != "" {
+			if err := ctx.MakeDirs(host, secret.StagingDirectory, true, 0700); err != nil {
+				return wrap(err)
+			}
+		}
 	}
 
-	err = ctx.UploadFile(host, utils.GetAbsPathRelativeTo(secret.Source, deploymentWD), tempPath)
+	isDirectory, err := IsDirectory(secret, deploymentWD)
 	if err != nil {
 		return wrap(err)
 	}
+	if isDirectory {
+		return uploadDirectory(ctx, host, secret, deploymentWD)
+	}
 
-	err = ctx.MoveFile(host, tempPath, secret.Destination)
+	content, err := ReadSecret(host, secret, deploymentWD)
 	if err != nil {
 		return wrap(err)
 	}
 
-	err = ctx.SetOwner(host, secret.Destination, secret.Owner.User, secret.Owner.Group)
+	// The staging file is created by root with mode 0600, and gets its final owner and permissions
+	// before any content is written to it. This way the plaintext is never readable by anyone else
+	// than root and the intended owner.
+	stagingPath, err := ctx.MakeTempFileIn(host, GetStagingDirectory(secret))
+	if err != nil {
+		return wrap(err)
+	}
+
+	err = ctx.SetOwner(host, stagingPath, secret.Owner.User, secret.Owner.Group)
 	if err != nil {
 		partialErr = wrapNonFatal(err)
 	}
 
-	err = ctx.SetPermissions(host, secret.Destination, secret.Permissions)
+	err = ctx.SetPermissions(host, stagingPath, secret.Permissions)
 	if err != nil {
 		partialErr = wrapNonFatal(err)
 	}
 
+	err = ctx.WriteFile(host, bytes.NewReader(content), stagingPath)
+	if err != nil {
+		ctx.RemovePath(host, stagingPath, false)
+		return wrap(err)
+	}
+
+	err = ctx.MoveFile(host, stagingPath, secret.Destination)
+	if err != nil {
+		ctx.RemovePath(host, stagingPath, false)
+		return wrap(err)
+	}
+
 	return partialErr
 }
@@ -0,0 +1,79 @@
+package secrets
+
+import (
+	"bytes"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+
+	"github.com/DBCDK/morph/ssh"
+	"github.com/DBCDK/morph/utils"
+)
+
+type Host interface {
+	ssh.Host
+	GetTags() []string
+}
+
+// Data available to templated secrets
+type TemplateData struct {
+	Host   TemplateHost
+	Values map[string]string
+}
+
+type TemplateHost struct {
+	Name       string
+	TargetHost string
+	TargetPort int
+	TargetUser string
+	Tags       []string
+}
+
+var templateFuncs = template.FuncMap{
+	"trim": strings.TrimSpace,
+}
+
+// Read the content of a secret, rendering it first if it's a template.
+// Templates are rendered in memory only and never written to the local disk.
+func ReadSecret(host Host, secret Secret, deploymentWD string) ([]byte, error) {
+	sourcePath := utils.GetAbsPathRelativeTo(secret.Source, deploymentWD)
+	if !secret.Template {
+		return os.ReadFile(sourcePath)
+	}
+
+	values := make(map[string]string)
+	for name, valuePath := range secret.TemplateValues {
+		value, err := os.ReadFile(utils.GetAbsPathRelativeTo(valuePath, deploymentWD))
+		if err != nil {
+			return nil, err
+		}
+		values[name] = string(value)
+	}
+
+	data := TemplateData{
+		Host: TemplateHost{
+			Name:       host.GetName(),
+			TargetHost: host.GetTargetHost(),
+			TargetPort: host.GetTargetPort(),
+			TargetUser: host.GetTargetUser(),
+			Tags:       host.GetTags(),
+		},
+		Values: values,
+	}
+
+	tmpl, err := template.New(filepath.Base(sourcePath)).
+		Option("missingkey=error").
+		Funcs(templateFuncs).
+		ParseFiles(sourcePath)
+	if err != nil {
+		return nil, err
+	}
+
+	var rendered bytes.Buffer
+	if err = tmpl.Execute(&rendered, data); err != nil {
+		return nil, err
+	}
+
+	return rendered.Bytes(), nil
+}
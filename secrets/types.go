@@ -4,13 +4,43 @@ import "fmt"
 import "strings"
 
 type Secret struct {
-	Source      string
-	Destination string
-	Owner       Owner
+	Source          string
+	Destination     string
+	Owner           Owner
+	Permissions     string
+	Action          []string
+	ActionOrder     int
+	OnActionFailure string
+	ActionTimeout   int
+	MkDirs          bool
+	UploadAt        string
+	Template        bool
+	TemplateValues  map[string]string
+	// directory on the remote host secrets are staged in before being moved into place
+	StagingDirectory string
+	// only used when Source is a directory
+	DirectoryPermissions string
+	Files                map[string]SecretFile
+}
+
+// Per-file overrides for secrets uploaded as a directory
+type SecretFile struct {
+	Owner       *Owner
 	Permissions string
-	Action      []string
-	MkDirs      bool
-	UploadAt    string
+}
+
+// The owner and permissions a file below a directory secret should end up with
+func (s *Secret) FileAttributes(relPath string) (owner Owner, permissions string) {
+	owner, permissions = s.Owner, s.Permissions
+	if file, ok := s.Files[relPath]; ok {
+		if file.Owner != nil {
+			owner = *file.Owner
+		}
+		if file.Permissions != "" {
+			permissions = file.Permissions
+		}
+	}
+	return
 }
 
 type Owner struct {
@@ -24,8 +54,20 @@ func (s *Secret) String() string {
 	fmt.Fprintf(&string_repr, "`%s` -> `%s`, with:\n\tPermissions: %s:%s, %s\n\tCreate remote directories: %t\n\tUpload at: %s",
 		s.Source, s.Destination, s.Owner.User, s.Owner.Group, s.Permissions, s.MkDirs, s.UploadAt)
 
+	for relPath, file := range s.Files {
+		owner, permissions := s.FileAttributes(relPath)
+		if file.Owner != nil || file.Permissions != "" {
+			fmt.Fprintf(&string_repr, "\n\tFile `%s`: %s:%s, %s", relPath, owner.User, owner.Group, permissions)
+		}
+	}
+
+	if s.Template {
+		fmt.Fprintf(&string_repr, "\n\tTemplate: %t", s.Template)
+	}
+
 	if len(s.Action) > 0 {
-		fmt.Fprintf(&string_repr, "\n\tAction: `%s`", strings.Join(s.Action, " "))
+		fmt.Fprintf(&string_repr, "\n\tAction: `%s` (order: %d, on failure: %s, timeout: %ds)",
+			strings.Join(s.Action, " "), s.ActionOrder, s.OnActionFailure, s.ActionTimeout)
 	}
 
 	return string_repr.String()
@@ -0,0 +1,233 @@
+package secrets
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+
+	"github.com/DBCDK/morph/ssh"
+	"github.com/DBCDK/morph/utils"
+)
+
+type DriftStatus string
+
+const (
+	DriftNone     DriftStatus = "ok"
+	DriftMissing  DriftStatus = "missing"
+	DriftModified DriftStatus = "modified"
+	DriftExtra    DriftStatus = "extra"
+	// the secret couldn't be verified, e.g. because the host was unreachable
+	DriftError DriftStatus = "error"
+)
+
+type VerifyResult struct {
+	Host        string      `json:"host"`
+	Secret      string      `json:"secret"`
+	Destination string      `json:"destination"`
+	Status      DriftStatus `json:"status"`
+	Differences []string    `json:"differences,omitempty"`
+}
+
+func (r VerifyResult) IsDrift() bool {
+	return r.Status != DriftNone && r.Status != DriftError
+}
+
+func GetSecretChecksum(host Host, secret Secret, deploymentWD string) (checksum string, err error) {
+	content, err := ReadSecret(host, secret, deploymentWD)
+	if err != nil {
+		return "", err
+	}
+
+	hash := sha256.Sum256(content)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+// Compare a secret on the remote host to its local source. Only metadata and a checksum of the
+// remote file is transferred, never the content itself.
+// Directory secrets produce a result for each file in the directory.
+func VerifySecret(ctx ssh.Context, host Host, name string, secret Secret, deploymentWD string) (results []VerifyResult, err error) {
+	isDirectory, err := IsDirectory(secret, deploymentWD)
+	if err != nil {
+		return results, err
+	}
+	if isDirectory {
+		return verifyDirectory(ctx, host, name, secret, deploymentWD)
+	}
+
+	localChecksum, err := GetSecretChecksum(host, secret, deploymentWD)
+	if err != nil {
+		return results, err
+	}
+
+	result, err := verifyFile(ctx, host, name, secret.Destination, secret.Owner, secret.Permissions, localChecksum)
+	if err != nil {
+		return results, err
+	}
+	return append(results, result), nil
+}
+
+func verifyDirectory(ctx ssh.Context, host Host, name string, secret Secret, deploymentWD string) (results []VerifyResult, err error) {
+	info, err := ctx.StatFile(host, secret.Destination)
+	if err != nil {
+		return results, err
+	}
+	if info == nil {
+		results = append(results, VerifyResult{
+			Host:        host.GetName(),
+			Secret:      name,
+			Destination: secret.Destination,
+			Status:      DriftMissing,
+		})
+		return results, nil
+	}
+
+	sourcePath := utils.GetAbsPathRelativeTo(secret.Source, deploymentWD)
+	localFiles, err := listFiles(sourcePath)
+	if err != nil {
+		return results, err
+	}
+
+	declared := make(map[string]bool)
+	for _, relPath := range localFiles {
+		destination := filepath.Join(secret.Destination, relPath)
+		declared[destination] = true
+
+		localChecksum, err := fileChecksum(filepath.Join(sourcePath, relPath))
+		if err != nil {
+			return results, err
+		}
+
+		owner, permissions := secret.FileAttributes(relPath)
+		result, err := verifyFile(ctx, host, name, destination, owner, permissions, localChecksum)
+		if err != nil {
+			return results, err
+		}
+		results = append(results, result)
+	}
+
+	remoteFiles, err := ctx.ListFiles(host, secret.Destination, true)
+	if err != nil {
+		return results, err
+	}
+	for _, file := range remoteFiles {
+		if !declared[file] {
+			results = append(results, VerifyResult{
+				Host:        host.GetName(),
+				Secret:      name,
+				Destination: file,
+				Status:      DriftExtra,
+			})
+		}
+	}
+
+	return results, nil
+}
+
+// The result is only meaningful if err is nil, since the file couldn't be checked otherwise
+func verifyFile(ctx ssh.Context, host Host, name string, destination string, owner Owner, permissions string, localChecksum string) (result VerifyResult, err error) {
+	result = VerifyResult{
+		Host:        host.GetName(),
+		Secret:      name,
+		Destination: destination,
+		Status:      DriftNone,
+	}
+
+	info, err := ctx.StatFile(host, destination)
+	if err != nil {
+		return result, err
+	}
+	if info == nil {
+		result.Status = DriftMissing
+		return result, nil
+	}
+
+	if info.User != owner.User && info.UID != owner.User {
+		result.Differences = append(result.Differences, fmt.Sprintf("owner: expected %s, found %s", owner.User, info.User))
+	}
+	if info.Group != owner.Group && info.GID != owner.Group {
+		result.Differences = append(result.Differences, fmt.Sprintf("group: expected %s, found %s", owner.Group, info.Group))
+	}
+	// symbolic permissions (e.g. "u=r") can't be compared to what stat reports, so they are skipped
+	if expected, ok := normalizeMode(permissions); ok {
+		if found, _ := normalizeMode(info.Mode); found != expected {
+			result.Differences = append(result.Differences, fmt.Sprintf("mode: expected %s, found %s", expected, found))
+		}
+	}
+
+	remoteChecksum, err := ctx.FileChecksum(host, destination)
+	if err != nil {
+		return result, err
+	}
+	if remoteChecksum != localChecksum {
+		result.Differences = append(result.Differences, "content: checksum differs from local source")
+	}
+
+	if len(result.Differences) > 0 {
+		result.Status = DriftModified
+	}
+
+	return result, nil
+}
+
+func fileChecksum(path string) (checksum string, err error) {
+	fh, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer fh.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, fh); err != nil {
+		return "", err
+	}
+
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+// Find files on the remote host which live next to a secret, but aren't declared as secrets themselves.
+func FindExtraFiles(ctx ssh.Context, host ssh.Host, secrets map[string]Secret) (results []VerifyResult, err error) {
+	declared := make(map[string]bool)
+	directories := make(map[string]bool)
+	for _, secret := range secrets {
+		declared[secret.Destination] = true
+		directories[filepath.Dir(secret.Destination)] = true
+	}
+
+	sortedDirectories := make([]string, 0, len(directories))
+	for directory := range directories {
+		sortedDirectories = append(sortedDirectories, directory)
+	}
+	sort.Strings(sortedDirectories)
+
+	for _, directory := range sortedDirectories {
+		files, err := ctx.ListFiles(host, directory, false)
+		if err != nil {
+			return results, err
+		}
+		for _, file := range files {
+			if declared[file] {
+				continue
+			}
+			results = append(results, VerifyResult{
+				Host:        host.GetName(),
+				Destination: file,
+				Status:      DriftExtra,
+			})
+		}
+	}
+
+	return results, nil
+}
+
+func normalizeMode(mode string) (string, bool) {
+	value, err := strconv.ParseUint(mode, 8, 32)
+	if err != nil {
+		return mode, false
+	}
+	return fmt.Sprintf("%04o", value), true
+}
@@ -5,6 +5,7 @@ import (
 	"context"
 	"errors"
 	"fmt"
+	"github.com/DBCDK/morph/events"
 	"github.com/DBCDK/morph/utils"
 	"golang.org/x/crypto/ssh/terminal"
 	"io"
@@ -18,17 +19,27 @@ import (
 
 type Context interface {
 	ActivateConfiguration(host Host, configuration string, action string) error
-	MakeTempFile(host Host) (path string, err error)
-	UploadFile(host Host, source string, destination string) error
+	MakeTempFileIn(host Host, directory string) (path string, err error)
+	WriteFile(host Host, data io.Reader, destination string) error
+	RemovePath(host Host, path string, recursive bool) error
 	SetOwner(host Host, path string, user string, group string) error
 	SetPermissions(host Host, path string, permissions string) error
 	MoveFile(host Host, source string, destination string) error
 	MakeDirs(host Host, path string, parents bool, mode os.FileMode) error
 	WaitForMountPoints(host Host, path string) error
+	StatFile(host Host, path string) (info *FileInfo, err error)
+	FileChecksum(host Host, path string) (checksum string, err error)
+	ListFiles(host Host, path string, recursive bool) (files []string, err error)
+	MakeTempDir(host Host, parent string) (path string, err error)
+	ExtractArchive(host Host, archive io.Reader, destination string) error
+	ReplaceDirectory(host Host, source string, destination string) error
+	SetOwnerRecursive(host Host, path string, user string, group string) error
+	SetPermissionsRecursive(host Host, path string, fileType string, permissions string) error
 
 	Cmd(host Host, parts ...string) (*exec.Cmd, error)
 	SudoCmd(host Host, parts ...string) (*exec.Cmd, error)
-	CmdInteractive(host Host, timeout int, parts ...string)
+	SudoCmdWithInput(host Host, input io.Reader, parts ...string) (*exec.Cmd, error)
+	CmdInteractive(host Host, timeout int, parts ...string) error
 }
 
 type Host interface {
@@ -48,9 +59,14 @@ type SSHContext struct {
 	SkipHostKeyCheck       bool
 }
 
-type FileTransfer struct {
-	Source      string
-	Destination string
+// Ownership and permissions of a file on a remote host, as reported by stat(1)
+type FileInfo struct {
+	User  string
+	Group string
+	UID   string
+	GID   string
+	Mode  string
+	Type  string
 }
 
 func (sshCtx *SSHContext) Cmd(host Host, parts ...string) (*exec.Cmd, error) {
@@ -68,19 +84,15 @@ func (sshCtx *SSHContext) CmdContext(ctx context.Context, host Host, parts ...st
 		return sshCtx.SudoCmdContext(ctx, host, parts...)
 	}
 
-	cmd, cmdArgs := sshCtx.sshArgs(host, nil)
+	cmd, cmdArgs := sshCtx.sshArgs(host)
 	cmdArgs = append(cmdArgs, parts...)
 
 	command := exec.CommandContext(ctx, cmd, cmdArgs...)
 	return command, nil
 }
 
-func (ctx *SSHContext) sshArgs(host Host, transfer *FileTransfer) (cmd string, args []string) {
-	if transfer != nil {
-		cmd = "scp"
-	} else {
-		cmd = "ssh"
-	}
+func (ctx *SSHContext) sshArgs(host Host) (cmd string, args []string) {
+	cmd = "ssh"
 	utils.ValidateEnvironment(cmd)
 
 	if ctx.SkipHostKeyCheck {
@@ -97,20 +109,9 @@ func (ctx *SSHContext) sshArgs(host Host, transfer *FileTransfer) (cmd string, a
 	}
 	var hostAndDestination = host.GetTargetHost()
 	if host.GetTargetPort() != 0 {
-		var optionName string
-		if transfer != nil {
-			optionName = "-P"
-		} else {
-			optionName = "-p"
-		}
-
-		args = append(args, optionName, fmt.Sprintf("%d", host.GetTargetPort()))
+		args = append(args, "-p", fmt.Sprintf("%d", host.GetTargetPort()))
 	}
 
-	if transfer != nil {
-		args = append(args, transfer.Source)
-		hostAndDestination += ":" + transfer.Destination
-	}
 	if host.GetTargetUser() != "" {
 		hostAndDestination = host.GetTargetUser() + "@" + hostAndDestination
 	} else if ctx.DefaultUsername != "" {
@@ -126,6 +127,15 @@ func (sshCtx *SSHContext) SudoCmd(host Host, parts ...string) (*exec.Cmd, error)
 }
 
 func (sshCtx *SSHContext) SudoCmdContext(ctx context.Context, host Host, parts ...string) (*exec.Cmd, error) {
+	return sshCtx.sudoCmdContext(ctx, host, nil, parts...)
+}
+
+// Like SudoCmd, but with input fed to the remote command on stdin (following the sudo password, if any)
+func (sshCtx *SSHContext) SudoCmdWithInput(host Host, input io.Reader, parts ...string) (*exec.Cmd, error) {
+	return sshCtx.sudoCmdContext(context.TODO(), host, input, parts...)
+}
+
+func (sshCtx *SSHContext) sudoCmdContext(ctx context.Context, host Host, input io.Reader, parts ...string) (*exec.Cmd, error) {
 	var err error
 	if parts, err = valCommand(parts); err != nil {
 		return nil, err
@@ -154,7 +164,7 @@ func (sshCtx *SSHContext) SudoCmdContext(ctx context.Context, host Host, parts .
 		sshCtx.sudoPassword = string(passOut)
 	}
 
-	cmd, cmdArgs := sshCtx.sshArgs(host, nil)
+	cmd, cmdArgs := sshCtx.sshArgs(host)
 
 	// normalize sudo
 	if parts[0] == "sudo" {
@@ -173,7 +183,13 @@ func (sshCtx *SSHContext) SudoCmdContext(ctx context.Context, host Host, parts .
 	cmdArgs = append(cmdArgs, parts...)
 
 	command := exec.CommandContext(ctx, cmd, cmdArgs...)
-	if sshCtx.sudoPassword != "" {
+	if input != nil {
+		// sudo reads the password one byte at a time, leaving the rest of stdin for the command
+		if sshCtx.sudoPassword != "" {
+			input = io.MultiReader(strings.NewReader(sshCtx.sudoPassword+"\n"), input)
+		}
+		command.Stdin = input
+	} else if sshCtx.sudoPassword != "" {
 		err := writeSudoPassword(command, sshCtx.sudoPassword)
 		if err != nil {
 			return nil, err
@@ -191,30 +207,35 @@ func valCommand(parts []string) ([]string, error) {
 	return parts, nil
 }
 
-func (sshCtx *SSHContext) CmdInteractive(host Host, timeout int, parts ...string) {
-	ctx, cancel := utils.ContextWithConditionalTimeout(context.TODO(), timeout)
+// Run a command with its output going to stderr (or output events). Failures are returned, not printed,
+// since whether they matter is up to the caller.
+func (sshCtx *SSHContext) CmdInteractive(host Host, timeout int, parts ...string) error {
+	defer utils.TrackWork()()
+	ctx, cancel := utils.ContextWithConditionalTimeout(utils.Context(), timeout)
 	defer cancel()
 
 	cmd, err := sshCtx.CmdContext(ctx, host, parts...)
 	if err == nil {
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
+		output, flush := events.Output(host.GetName(), "exec")
+		cmd.Stdout = output
+		cmd.Stderr = output
 		err = cmd.Run()
+		flush()
 	}
 
 	// context was cancelled
+	if utils.Context().Err() != nil {
+		return errors.New("interrupted")
+	}
 	if ctx.Err() != nil {
-		fmt.Fprintf(os.Stderr, "Exec of cmd: %s timed out\n", parts)
-		return
+		return fmt.Errorf("timed out after %ds", timeout)
 	}
 
-	if err != nil {
-		fmt.Fprintf(os.Stderr, "Exec of cmd: %s failed with err: '%s'\n", parts, err.Error())
-	}
+	return err
 }
 
 func askForSudoPassword() (string, error) {
-	fmt.Fprint(os.Stderr, "Please enter remote sudo password: ")
+	events.Printf("Please enter remote sudo password: ")
 	stdin := int(syscall.Stdin)
 	state, err := terminal.GetState(stdin)
 	if err != nil {
@@ -227,7 +248,7 @@ func askForSudoPassword() (string, error) {
 	if err != nil {
 		return "", err
 	}
-	fmt.Fprintln(os.Stderr)
+	events.Println()
 	return string(bytePassword), nil
 }
 
@@ -250,9 +271,11 @@ func (ctx *SSHContext) ActivateConfiguration(host Host, configuration string, ac
 			return err
 		}
 
-		cmd.Stdout = os.Stderr
-		cmd.Stderr = os.Stderr
+		output, flush := events.Output(host.GetName(), "nix-env")
+		cmd.Stdout = output
+		cmd.Stderr = output
 		err = cmd.Run()
+		flush()
 		if err != nil {
 			return err
 		}
@@ -269,9 +292,11 @@ func (ctx *SSHContext) ActivateConfiguration(host Host, configuration string, ac
 		return err
 	}
 
-	cmd.Stdout = os.Stderr
-	cmd.Stderr = os.Stderr
+	output, flush := events.Output(host.GetName(), "switch-to-configuration")
+	cmd.Stdout = output
+	cmd.Stderr = output
 	err = cmd.Run()
+	flush()
 	if err != nil {
 		return errors.New("Error while activating new configuration.")
 	}
@@ -289,7 +314,9 @@ func (sshCtx *SSHContext) GetBootID(host Host) (string, error) {
 
 	var stdout bytes.Buffer
 	cmd.Stdout = &stdout
-	cmd.Stderr = os.Stderr
+	stderr, flush := events.Output(host.GetName(), "ssh")
+	defer flush()
+	cmd.Stderr = stderr
 
 	err = cmd.Run()
 	if err != nil {
@@ -299,8 +326,12 @@ func (sshCtx *SSHContext) GetBootID(host Host) (string, error) {
 	return strings.TrimSpace(stdout.String()), nil
 }
 
-func (ctx *SSHContext) MakeTempFile(host Host) (path string, err error) {
-	cmd, _ := ctx.Cmd(host, "mktemp")
+// Create an empty file owned by root with mode 0600 in the given directory on the remote host
+func (ctx *SSHContext) MakeTempFileIn(host Host, directory string) (path string, err error) {
+	cmd, err := ctx.SudoCmd(host, "mktemp", "--tmpdir="+directory, ".morph-XXXXXXXXXX")
+	if err != nil {
+		return "", err
+	}
 
 	var stdout bytes.Buffer
 	var stderr bytes.Buffer
@@ -310,29 +341,27 @@ func (ctx *SSHContext) MakeTempFile(host Host) (path string, err error) {
 	err = cmd.Run()
 	if err != nil {
 		errorMessage := fmt.Sprintf(
-			"Error on remote host %s (%s):\nCouldn't create temporary file using mktemp\n\nOriginal error:\n%s",
-			host.GetName(), host.GetTargetHost(), stderr.String(),
+			"Error on remote host %s (%s):\nCouldn't create temporary file in %s using mktemp\n\nOriginal error:\n%s",
+			host.GetName(), host.GetTargetHost(), directory, stderr.String(),
 		)
 		return "", errors.New(errorMessage)
 	}
 
-	tempFile := strings.TrimSpace(stdout.String())
-
-	return tempFile, nil
+	return strings.TrimSpace(stdout.String()), nil
 }
 
-func (ctx *SSHContext) UploadFile(host Host, source string, destination string) (err error) {
-	c, parts := ctx.sshArgs(host, &FileTransfer{
-		Source:      source,
-		Destination: destination,
-	})
-	cmd := exec.Command(c, parts...)
+// Write data to a file on the remote host as root. An existing file keeps its owner and permissions.
+func (ctx *SSHContext) WriteFile(host Host, data io.Reader, destination string) (err error) {
+	cmd, err := ctx.SudoCmdWithInput(host, data, "dd", "of="+destination, "status=none")
+	if err != nil {
+		return err
+	}
 
-	data, err := cmd.CombinedOutput()
+	output, err := cmd.CombinedOutput()
 	if err != nil {
 		errorMessage := fmt.Sprintf(
-			"Error on remote host %s (%s):\nCouldn't upload file: %s -> %s\n\nOriginal error:\n%s",
-			host.GetName(), host.GetTargetHost(), source, destination, string(data),
+			"Error on remote host %s (%s):\nCouldn't write data to: %s\n\nOriginal error:\n%s",
+			host.GetName(), host.GetTargetHost(), destination, string(output),
 		)
 		return errors.New(errorMessage)
 	}
@@ -340,6 +369,20 @@ func (ctx *SSHContext) UploadFile(host Host, source string, destination string)
 	return nil
 }
 
+func (ctx *SSHContext) RemovePath(host Host, path string, recursive bool) (err error) {
+	parts := []string{"rm", "--force"}
+	if recursive {
+		parts = append(parts, "--recursive")
+	}
+	parts = append(parts, path)
+
+	if err = ctx.runSudo(host, parts...); err != nil {
+		return fmt.Errorf("\tCouldn't remove: %s:\n\t%s", path, err)
+	}
+
+	return nil
+}
+
 func (ctx *SSHContext) MakeDirs(host Host, path string, parents bool, mode os.FileMode) (err error) {
 
 	parts := make([]string, 0)
@@ -434,3 +477,224 @@ func (ctx *SSHContext) WaitForMountPoints(host Host, path string) (err error) {
 
 	return nil
 }
+
+func (ctx *SSHContext) StatFile(host Host, path string) (info *FileInfo, err error) {
+	// force the C locale, so we can tell a missing file apart from other errors
+	cmd, err := ctx.SudoCmd(host, "env", "LC_ALL=C", "stat", "--format=%U:%G:%u:%g:%a:%F", path)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		if strings.Contains(stderr.String(), "No such file or directory") {
+			return nil, nil
+		}
+		errorMessage := fmt.Sprintf(
+			"\tCouldn't stat file: %s:\n\t%s", path, stderr.String(),
+		)
+		return nil, errors.New(errorMessage)
+	}
+
+	fields := strings.SplitN(strings.TrimSpace(stdout.String()), ":", 6)
+	if len(fields) != 6 {
+		return nil, fmt.Errorf("\tUnexpected output from stat for file: %s:\n\t%s", path, stdout.String())
+	}
+
+	return &FileInfo{
+		User:  fields[0],
+		Group: fields[1],
+		UID:   fields[2],
+		GID:   fields[3],
+		Mode:  fields[4],
+		Type:  fields[5],
+	}, nil
+}
+
+func (ctx *SSHContext) FileChecksum(host Host, path string) (checksum string, err error) {
+	cmd, err := ctx.SudoCmd(host, "sha256sum", path)
+	if err != nil {
+		return "", err
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"\tCouldn't checksum file: %s:\n\t%s", path, stderr.String(),
+		)
+		return "", errors.New(errorMessage)
+	}
+
+	fields := strings.Fields(stdout.String())
+	if len(fields) == 0 {
+		return "", fmt.Errorf("\tUnexpected output from sha256sum for file: %s", path)
+	}
+
+	return fields[0], nil
+}
+
+func (ctx *SSHContext) ListFiles(host Host, path string, recursive bool) (files []string, err error) {
+	parts := []string{"env", "LC_ALL=C", "find", path, "-mindepth", "1"}
+	if !recursive {
+		parts = append(parts, "-maxdepth", "1")
+	}
+	parts = append(parts, "-type", "f")
+
+	cmd, err := ctx.SudoCmd(host, parts...)
+	if err != nil {
+		return nil, err
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		// a directory that doesn't exist contains no files
+		if strings.Contains(stderr.String(), "No such file or directory") {
+			return files, nil
+		}
+		errorMessage := fmt.Sprintf(
+			"\tCouldn't list files in: %s:\n\t%s", path, stderr.String(),
+		)
+		return nil, errors.New(errorMessage)
+	}
+
+	for _, line := range strings.Split(stdout.String(), "\n") {
+		if line != "" {
+			files = append(files, line)
+		}
+	}
+
+	return files, nil
+}
+
+func (ctx *SSHContext) MakeTempDir(host Host, parent string) (path string, err error) {
+	// the directory is created by root with mode 0700, so nothing placed in it is readable by others
+	cmd, err := ctx.SudoCmd(host, "mktemp", "--directory", "--tmpdir="+parent, ".morph-XXXXXXXXXX")
+	if err != nil {
+		return "", err
+	}
+
+	var stdout bytes.Buffer
+	var stderr bytes.Buffer
+	cmd.Stdout = &stdout
+	cmd.Stderr = &stderr
+
+	err = cmd.Run()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"Error on remote host %s (%s):\nCouldn't create temporary directory in %s using mktemp\n\nOriginal error:\n%s",
+			host.GetName(), host.GetTargetHost(), parent, stderr.String(),
+		)
+		return "", errors.New(errorMessage)
+	}
+
+	return strings.TrimSpace(stdout.String()), nil
+}
+
+func (ctx *SSHContext) ExtractArchive(host Host, archive io.Reader, destination string) (err error) {
+	cmd, err := ctx.SudoCmdWithInput(host, archive, "tar", "--extract", "--no-same-owner", "--no-same-permissions", "--directory="+destination, "--file=-")
+	if err != nil {
+		return err
+	}
+
+	data, err := cmd.CombinedOutput()
+	if err != nil {
+		errorMessage := fmt.Sprintf(
+			"\tCouldn't extract archive to: %s:\n\t%s", destination, string(data),
+		)
+		return errors.New(errorMessage)
+	}
+
+	return nil
+}
+
+// Move a directory into place, replacing any existing file or directory at the destination.
+// When the remote mv supports --exchange (coreutils 9.5 and later), the old and new directory are
+// swapped atomically. Otherwise the existing destination is renamed out of the way first, and moved
+// back if the new directory can't be moved into place.
+func (ctx *SSHContext) ReplaceDirectory(host Host, source string, destination string) (err error) {
+	existing, err := ctx.StatFile(host, destination)
+	if err != nil {
+		return err
+	}
+
+	if existing == nil {
+		if err = ctx.runSudo(host, "mv", "--no-target-directory", source, destination); err != nil {
+			return fmt.Errorf("\tCouldn't move directory: %s -> %s:\n\t%s", source, destination, err)
+		}
+		return nil
+	}
+
+	// after the exchange, source holds the previous version
+	previous := source
+	if err = ctx.runSudo(host, "mv", "--exchange", "--no-target-directory", source, destination); err != nil {
+		previous = destination + ".morph-old"
+
+		// left behind by an earlier run that was interrupted
+		if err = ctx.runSudo(host, "rm", "--recursive", "--force", previous); err != nil {
+			return fmt.Errorf("\tCouldn't remove stale %s:\n\t%s", previous, err)
+		}
+
+		if err = ctx.runSudo(host, "mv", "--no-target-directory", destination, previous); err != nil {
+			return fmt.Errorf("\tCouldn't move %s out of the way:\n\t%s", destination, err)
+		}
+
+		if err = ctx.runSudo(host, "mv", "--no-target-directory", source, destination); err != nil {
+			if restoreErr := ctx.runSudo(host, "mv", "--no-target-directory", previous, destination); restoreErr != nil {
+				return fmt.Errorf("\tCouldn't move directory: %s -> %s:\n\t%s\n\tCouldn't restore the previous version from %s either:\n\t%s", source, destination, err, previous, restoreErr)
+			}
+			return fmt.Errorf("\tCouldn't move directory: %s -> %s:\n\t%s", source, destination, err)
+		}
+	}
+
+	if err = ctx.runSudo(host, "rm", "--recursive", "--force", previous); err != nil {
+		return fmt.Errorf("\tCouldn't remove previous version of %s:\n\t%s", destination, err)
+	}
+
+	return nil
+}
+
+func (ctx *SSHContext) SetOwnerRecursive(host Host, path string, user string, group string) (err error) {
+	if err = ctx.runSudo(host, "chown", "--recursive", user+":"+group, path); err != nil {
+		return fmt.Errorf("\tCouldn't chown directory: %s:\n\t%s", path, err)
+	}
+
+	return nil
+}
+
+// Set permissions on everything of the given type (as understood by `find -type`) below and including path
+func (ctx *SSHContext) SetPermissionsRecursive(host Host, path string, fileType string, permissions string) (err error) {
+	if err = ctx.runSudo(host, "find", path, "-type", fileType, "-exec", "chmod", permissions, "{}", "+"); err != nil {
+		return fmt.Errorf("\tCouldn't chmod contents of directory: %s:\n\t%s", path, err)
+	}
+
+	return nil
+}
+
+func (ctx *SSHContext) runSudo(host Host, parts ...string) error {
+	cmd, err := ctx.SudoCmd(host, parts...)
+	if err != nil {
+		return err
+	}
+
+	data, err := cmd.CombinedOutput()
+	if err != nil {
+		return errors.New(strings.TrimSpace(string(data)))
+	}
+
+	return nil
+}
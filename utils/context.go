@@ -2,6 +2,7 @@ package utils
 
 import (
 	"context"
+	"sync"
 	"time"
 )
 
@@ -13,10 +14,46 @@ func ContextWithConditionalTimeout(parent context.Context, timeout int) (context
 	)
 
 	if timeout <= 0 {
-		ctx, cancel = context.WithCancel(context.TODO())
+		ctx, cancel = context.WithCancel(parent)
 	} else {
-		ctx, cancel = context.WithTimeout(context.TODO(), time.Duration(timeout)*time.Second)
+		ctx, cancel = context.WithTimeout(parent, time.Duration(timeout)*time.Second)
 	}
 
 	return ctx, cancel
 }
+
+var rootContext, cancelRootContext = context.WithCancel(context.Background())
+
+// Work using the root context, which is waited for when morph is interrupted
+var inFlight sync.WaitGroup
+
+// How long to wait for work in flight to stop after the root context has been cancelled
+const interruptGracePeriod = 5 * time.Second
+
+// Context which is cancelled when morph is interrupted. Long running operations should derive their
+// contexts from this, so their subprocesses are killed before morph exits.
+func Context() context.Context {
+	return rootContext
+}
+
+// Register work (e.g. a subprocess) using Context(). The returned function must be called once the work
+// has stopped. When morph is interrupted, it waits a short while for registered work to stop after
+// cancelling Context(), so subprocesses are killed and reaped instead of being left behind.
+func TrackWork() (done func()) {
+	inFlight.Add(1)
+	return inFlight.Done
+}
+
+// Wait for tracked work to stop, but no longer than the grace period
+func waitForWork() {
+	stopped := make(chan struct{})
+	go func() {
+		inFlight.Wait()
+		close(stopped)
+	}()
+
+	select {
+	case <-stopped:
+	case <-time.After(interruptGracePeriod):
+	}
+}
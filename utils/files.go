@@ -1,9 +1,7 @@
 package utils
 
 import (
-	"errors"
-	"fmt"
-	"os"
+	"github.com/DBCDK/morph/events"
 	"os/exec"
 	"path/filepath"
 	"strings"
@@ -27,7 +25,10 @@ func ValidateEnvironment(dependencies ...string) {
 	}
 
 	if len(missingDepencies) > 0 {
-		fmt.Fprint(os.Stderr, errors.New("Missing dependencies: '"+strings.Join(missingDepencies, ", ")+"' on $PATH"))
+		events.Emit(events.Event{
+			Type:    events.Error,
+			Message: "Missing dependencies: '" + strings.Join(missingDepencies, ", ") + "' on $PATH\n",
+		})
 		Exit(1)
 	}
 }
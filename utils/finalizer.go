@@ -1,7 +1,7 @@
 package utils
 
 import (
-	"fmt"
+	"github.com/DBCDK/morph/events"
 	"os"
 	"os/signal"
 	"syscall"
@@ -45,7 +45,9 @@ func SignalHandler() {
 	signal.Notify(sigs, syscall.SIGINT, syscall.SIGTERM)
 	go func() {
 		sig := <-sigs
-		fmt.Fprintf(os.Stderr, "Received signal: %s\n", sig.String())
+		events.Printf("Received signal: %s\n", sig.String())
+		cancelRootContext()
+		waitForWork()
 		Exit(130) // reserved exit code for "Interrupted"
 	}()
 }